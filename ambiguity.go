@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/dynamic"
+)
+
+// deleteSuspicious deletes objects that match the cattle selectors without
+// looking rancher created without asking first, see --delete-suspicious.
+var deleteSuspicious bool
+
+// rancherManagers are matched against the field managers of an object, any
+// of them writing to it marks the object as rancher's.
+var rancherManagers = []string{"rancher", "cattle", "norman"}
+
+var rbacGroupVersion = schema.GroupVersion{Group: "rbac.authorization.k8s.io", Version: "v1"}
+
+// suspiciousReason returns why obj, which matches a cattle selector, may not
+// have been created by rancher, or an empty string when it looks like it was.
+// Objects without field managers can't be judged and are trusted.
+func suspiciousReason(obj *unstructured.Unstructured) string {
+	for _, ref := range obj.GetOwnerReferences() {
+		if gv, err := schema.ParseGroupVersion(ref.APIVersion); err == nil && isCattleGroup(gv.Group) {
+			return ""
+		}
+	}
+	for key := range obj.GetAnnotations() {
+		if key == "field.cattle.io/creatorId" || strings.Contains(key, "management.cattle.io") {
+			return ""
+		}
+	}
+	managedFields, _, _ := unstructured.NestedSlice(obj.Object, "metadata", "managedFields")
+	if len(managedFields) == 0 {
+		return ""
+	}
+	managers := []string{}
+	for _, field := range managedFields {
+		entry, ok := field.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		manager, _ := entry["manager"].(string)
+		for _, rancherManager := range rancherManagers {
+			if strings.Contains(strings.ToLower(manager), rancherManager) {
+				return ""
+			}
+		}
+		managers = append(managers, manager)
+	}
+	return "no cattle owner, creator annotation or rancher field manager, managed by " + strings.Join(managers, ", ")
+}
+
+// confirmSuspicious warns about a suspicious object and reports whether it
+// may be deleted anyway, it never is when nobody is there to answer.
+func confirmSuspicious(kind string, obj *unstructured.Unstructured, reason string) bool {
+	name := namespacedName(obj.GetNamespace(), obj.GetName())
+	logrus.Warnf("%s [%s] matches the cattle selectors but may not be rancher's: %s", kind, name, reason)
+	if deleteSuspicious {
+		return true
+	}
+	ok, err := confirm(fmt.Sprintf("delete %s [%s]?", kind, name))
+	return err == nil && ok
+}
+
+// keptReason returns why obj, which matches a cattle selector, belongs to a
+// kept cluster or user, or an empty string when it does not. Bindings are
+// kept when one of their subjects is a kept user.
+func keptReason(obj *unstructured.Unstructured) string {
+	if isKept(obj.GetName()) {
+		return "cluster is kept"
+	}
+	subjects, _, _ := unstructured.NestedSlice(obj.Object, "subjects")
+	for _, s := range subjects {
+		subject, ok := s.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		kind, _ := subject["kind"].(string)
+		name, _ := subject["name"].(string)
+		if kind == "User" && keepUsers[name] {
+			return "user is kept"
+		}
+	}
+	return ""
+}
+
+// selectedResourcesCleanup deletes the objects of resource matching opts,
+// objects of kept clusters and users and suspicious objects that are not
+// confirmed are left in place. A namespace without such objects is deleted
+// as a collection, the others one object at a time.
+func selectedResourcesCleanup(pool dynamic.ClientPool, gv schema.GroupVersion, resource *v1.APIResource, opts v1.ListOptions) error {
+	client, resource, err := resourceClient(pool, gv.WithKind(resource.Kind))
+	if meta.IsNoMatchError(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	obj, err := client.Resource(resource, "").List(opts)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	list, ok := obj.(*unstructured.UnstructuredList)
+	if !ok {
+		return fmt.Errorf("unexpected list type %T for %s", obj, resource.Name)
+	}
+	namespaces := sets.NewString()
+	filtered := sets.NewString()
+	deletes := []unstructured.Unstructured{}
+	for _, item := range list.Items {
+		if resource.Namespaced && skipNamespace(item.GetNamespace()) {
+			continue
+		}
+		namespaces.Insert(item.GetNamespace())
+		if reason := keptReason(&item); reason != "" {
+			recordSkip(objectOf(item.GetAPIVersion(), resource.Kind, &item), reason)
+			filtered.Insert(item.GetNamespace())
+			continue
+		}
+		if reason := suspiciousReason(&item); reason != "" && !confirmSuspicious(resource.Kind, &item, reason) {
+			recordSkip(objectOf(item.GetAPIVersion(), resource.Kind, &item), "suspicious: "+reason)
+			filtered.Insert(item.GetNamespace())
+			continue
+		}
+		deletes = append(deletes, item)
+	}
+	errs := []error{}
+	for _, namespace := range namespaces.Difference(filtered).List() {
+		logrus.Infof("deleting %s [%s]..", resource.Kind, namespacedName(namespace, "*"))
+		err := client.Resource(resource, namespace).DeleteCollection(getDeleteOptions(), opts)
+		if err = recordDelete(selectedObjects(gv.String(), resource.Kind, namespace, opts.LabelSelector), err); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, item := range deletes {
+		if !filtered.Has(item.GetNamespace()) {
+			continue
+		}
+		logrus.Infof("deleting %s [%s]..", resource.Kind, namespacedName(item.GetNamespace(), item.GetName()))
+		err := client.Resource(resource, item.GetNamespace()).Delete(item.GetName(), getDeleteOptions())
+		if err = recordDelete(objectOf(item.GetAPIVersion(), resource.Kind, &item), err); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return cleanupErrors(errs)
+	}
+	return nil
+}
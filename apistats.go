@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/client-go/rest"
+)
+
+// apiPhaseStats counts the api calls made during one cleanup phase by verb,
+// along with the calls the api server throttled and the time spent waiting
+// for responses. Watches are counted but their time is not.
+type apiPhaseStats struct {
+	Context   string         `json:"context,omitempty"`
+	Phase     string         `json:"phase"`
+	Calls     map[string]int `json:"calls"`
+	Throttled int            `json:"throttled"`
+	Seconds   float64        `json:"seconds"`
+}
+
+type apiStatsRecorder struct {
+	sync.Mutex
+	phase  string
+	phases []*apiPhaseStats
+}
+
+// apiStats records the api calls of the current cleanup run, see
+// withAPIStats.
+var apiStats = &apiStatsRecorder{}
+
+// start resets the recorder for a new run, calls are attributed to setup
+// until the first step runs.
+func (r *apiStatsRecorder) start() {
+	r.Lock()
+	defer r.Unlock()
+	r.phase = "setup"
+	r.phases = nil
+}
+
+// setPhase attributes the following calls to phase.
+func (r *apiStatsRecorder) setPhase(phase string) {
+	r.Lock()
+	defer r.Unlock()
+	r.phase = phase
+}
+
+func (r *apiStatsRecorder) record(verb string, took time.Duration, throttled bool) {
+	r.Lock()
+	defer r.Unlock()
+	var stats *apiPhaseStats
+	for _, s := range r.phases {
+		if s.Phase == r.phase {
+			stats = s
+		}
+	}
+	if stats == nil {
+		stats = &apiPhaseStats{Context: kubeContext, Phase: r.phase, Calls: map[string]int{}}
+		r.phases = append(r.phases, stats)
+	}
+	stats.Calls[verb]++
+	if throttled {
+		stats.Throttled++
+	}
+	stats.Seconds += took.Seconds()
+}
+
+// finish logs the statistics of every phase of the run and returns them.
+func (r *apiStatsRecorder) finish() []apiPhaseStats {
+	r.Lock()
+	defer r.Unlock()
+	phases := []apiPhaseStats{}
+	for _, stats := range r.phases {
+		verbs := []string{}
+		for verb := range stats.Calls {
+			verbs = append(verbs, verb)
+		}
+		sort.Strings(verbs)
+		calls := []string{}
+		for _, verb := range verbs {
+			calls = append(calls, fmt.Sprintf("%d %s", stats.Calls[verb], verb))
+		}
+		logrus.Infof("api calls in [%s]: %s, %d throttled, %.1fs", stats.Phase, strings.Join(calls, ", "), stats.Throttled, stats.Seconds)
+		phases = append(phases, *stats)
+	}
+	r.phases = nil
+	return phases
+}
+
+type statsRoundTripper struct {
+	transport http.RoundTripper
+}
+
+func (t *statsRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	verb := apiVerb(req)
+	start := time.Now()
+	resp, err := t.transport.RoundTrip(req)
+	took := time.Since(start)
+	if verb == "WATCH" {
+		took = 0
+	}
+	apiStats.record(verb, took, resp != nil && resp.StatusCode == http.StatusTooManyRequests)
+	return resp, err
+}
+
+// withAPIStats records every request of config in apiStats.
+func withAPIStats(config *rest.Config) {
+	wrap := config.WrapTransport
+	config.WrapTransport = func(rt http.RoundTripper) http.RoundTripper {
+		if wrap != nil {
+			rt = wrap(rt)
+		}
+		return &statsRoundTripper{transport: rt}
+	}
+}
+
+// apiVerb tells the kubernetes verb of req, collections are told from single
+// objects by their path.
+func apiVerb(req *http.Request) string {
+	switch req.Method {
+	case http.MethodGet:
+		if req.URL.Query().Get("watch") == "true" {
+			return "WATCH"
+		}
+		if isCollectionPath(req.URL.Path) {
+			return "LIST"
+		}
+		return "GET"
+	case http.MethodPost:
+		return "CREATE"
+	case http.MethodPut:
+		return "UPDATE"
+	case http.MethodPatch:
+		return "PATCH"
+	case http.MethodDelete:
+		if isCollectionPath(req.URL.Path) {
+			return "DELETECOLLECTION"
+		}
+		return "DELETE"
+	}
+	return req.Method
+}
+
+// isCollectionPath reports whether path is a resource collection like
+// /api/v1/namespaces/<ns>/secrets rather than an object or discovery.
+func isCollectionPath(path string) bool {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	switch {
+	case len(parts) > 2 && parts[0] == "api":
+		parts = parts[2:]
+	case len(parts) > 3 && parts[0] == "apis":
+		parts = parts[3:]
+	default:
+		return false
+	}
+	if len(parts) >= 3 && parts[0] == "namespaces" {
+		parts = parts[2:]
+	}
+	return len(parts) == 1
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// auditRecord is one line of the audit log. Hash chains every record to the
+// one before it so removing or editing a line breaks the chain.
+type auditRecord struct {
+	reportObject
+	Timestamp    time.Time `json:"timestamp"`
+	User         string    `json:"user"`
+	Result       string    `json:"result"`
+	Reason       string    `json:"reason,omitempty"`
+	PreviousHash string    `json:"previousHash"`
+}
+
+// auditLog appends a record of every delete and update to a file, see
+// --audit-log.
+type auditLog struct {
+	sync.Mutex
+	file     *os.File
+	user     string
+	lastHash string
+	// err is the first failure to write a record.
+	err error
+}
+
+// audit is nil unless --audit-log is set.
+var audit *auditLog
+
+// openAuditLog opens the audit log at path for appending, the hash chain
+// continues from the last record already in the file.
+func openAuditLog(path, user string) (*auditLog, error) {
+	lastHash := ""
+	if data, err := ioutil.ReadFile(path); err == nil {
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		scanner.Buffer(nil, len(data)+1)
+		for scanner.Scan() {
+			if line := scanner.Bytes(); len(line) > 0 {
+				lastHash = hashLine(line)
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{file: file, user: user, lastHash: lastHash}, nil
+}
+
+// write appends entry to the log and syncs it to disk. A record that can't be
+// written fails every later one too, the chain is broken from there on.
+func (a *auditLog) write(entry reportEntry) error {
+	if entry.Result == ResultSkipped {
+		return nil
+	}
+	a.Lock()
+	defer a.Unlock()
+	if a.err != nil {
+		return a.err
+	}
+	line, err := json.Marshal(auditRecord{
+		reportObject: entry.reportObject,
+		Timestamp:    entry.Timestamp,
+		User:         a.user,
+		Result:       entry.Result,
+		Reason:       entry.Reason,
+		PreviousHash: a.lastHash,
+	})
+	if err == nil {
+		_, err = a.file.Write(append(line, '\n'))
+	}
+	if err == nil {
+		err = a.file.Sync()
+	}
+	if err != nil {
+		a.err = fmt.Errorf("failed to write audit log [%s]: %v", a.file.Name(), err)
+		return a.err
+	}
+	a.lastHash = hashLine(line)
+	return nil
+}
+
+func (a *auditLog) close() error {
+	a.Lock()
+	defer a.Unlock()
+	if err := a.file.Sync(); err != nil {
+		a.file.Close()
+		return err
+	}
+	if err := a.file.Close(); err != nil {
+		return err
+	}
+	return a.err
+}
+
+func hashLine(line []byte) string {
+	sum := sha256.Sum256(line)
+	return hex.EncodeToString(sum[:])
+}
+
+// getKubeconfigUser returns the user of the context the cleanup connects
+// with, the service account when no kubeconfig is found in cluster.
+func getKubeconfigUser(ctx *cli.Context) string {
+	kubeConfig, err := getClientConfig(ctx.GlobalString("kubeconfig"), ctx.GlobalString("context")).RawConfig()
+	if err != nil {
+		return "unknown"
+	}
+	if len(kubeConfig.Contexts) == 0 && os.Getenv("KUBERNETES_SERVICE_HOST") != "" {
+		return "in-cluster service account"
+	}
+	name := kubeContext
+	if name == "" {
+		name = ctx.GlobalString("context")
+	}
+	if name == "" {
+		name = kubeConfig.CurrentContext
+	}
+	context, ok := kubeConfig.Contexts[name]
+	if !ok {
+		return "unknown"
+	}
+	return context.AuthInfo
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/kubernetes"
+)
+
+// removedUsers are the rancher users the cleanup removes. They are taken on
+// the management context and kept for the downstream contexts, which carry
+// bindings of the same users but not the users themselves.
+var removedUsers = sets.NewString()
+
+// deleteDanglingBindings deletes the bindings left with dangling rancher user
+// subjects only and drops those subjects from the others, see
+// --delete-dangling-bindings. They are only reported otherwise.
+var deleteDanglingBindings bool
+
+// danglingSubjects splits subjects into the removed rancher users and the
+// rest.
+func danglingSubjects(subjects []rbacv1.Subject) ([]string, []rbacv1.Subject) {
+	dangling := []string{}
+	kept := []rbacv1.Subject{}
+	for _, subject := range subjects {
+		if subject.Kind == rbacv1.UserKind && removedUsers.Has(subject.Name) {
+			dangling = append(dangling, subject.Name)
+			continue
+		}
+		kept = append(kept, subject)
+	}
+	return dangling, kept
+}
+
+// danglingBindingsCleanup finds the cluster role bindings and role bindings
+// the cattle selectors missed whose subjects reference removed rancher
+// users.
+func danglingBindingsCleanup(client *kubernetes.Clientset) error {
+	errs := []error{}
+	if targetsClusterScope() {
+		crbList, err := client.RbacV1().ClusterRoleBindings().List(v1.ListOptions{})
+		if err != nil {
+			return err
+		}
+		for _, crb := range crbList.Items {
+			dangling, kept := danglingSubjects(crb.Subjects)
+			if len(dangling) == 0 {
+				continue
+			}
+			obj := objectOf(rbacAPIVersion, "ClusterRoleBinding", &crb)
+			if !deleteDanglingBindings {
+				logrus.Warnf("cluster role binding [%s] references removed rancher users %s", crb.Name, strings.Join(dangling, ", "))
+				recordSkip(obj, fmt.Sprintf("references removed rancher users %s", strings.Join(dangling, ", ")))
+				continue
+			}
+			if len(kept) == 0 {
+				logrus.Infof("deleting cluster role binding [%s] of removed rancher users..", crb.Name)
+				err = recordDelete(obj, client.RbacV1().ClusterRoleBindings().Delete(crb.Name, getDeleteOptions()))
+			} else {
+				logrus.Infof("removing rancher users %s from cluster role binding [%s]..", strings.Join(dangling, ", "), crb.Name)
+				crb.Subjects = kept
+				_, err = client.RbacV1().ClusterRoleBindings().Update(&crb)
+				err = recordUpdate(obj, err)
+			}
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	rbList, err := client.RbacV1().RoleBindings("").List(v1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for _, rb := range rbList.Items {
+		if skipNamespace(rb.Namespace) {
+			continue
+		}
+		dangling, kept := danglingSubjects(rb.Subjects)
+		if len(dangling) == 0 {
+			continue
+		}
+		obj := objectOf(rbacAPIVersion, "RoleBinding", &rb)
+		if !deleteDanglingBindings {
+			logrus.Warnf("role binding [%s/%s] references removed rancher users %s", rb.Namespace, rb.Name, strings.Join(dangling, ", "))
+			recordSkip(obj, fmt.Sprintf("references removed rancher users %s", strings.Join(dangling, ", ")))
+			continue
+		}
+		if len(kept) == 0 {
+			logrus.Infof("deleting role binding [%s/%s] of removed rancher users..", rb.Namespace, rb.Name)
+			err = recordDelete(obj, client.RbacV1().RoleBindings(rb.Namespace).Delete(rb.Name, getDeleteOptions()))
+		} else {
+			logrus.Infof("removing rancher users %s from role binding [%s/%s]..", strings.Join(dangling, ", "), rb.Namespace, rb.Name)
+			rb.Subjects = kept
+			_, err = client.RbacV1().RoleBindings(rb.Namespace).Update(&rb)
+			err = recordUpdate(obj, err)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return cleanupErrors(errs)
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/client-go/rest"
+)
+
+// runContext is cancelled on SIGINT or SIGTERM and when --timeout expires.
+// The vendored client-go takes no context arguments, so it is attached to
+// every api request at the transport, see withRunContext.
+var (
+	runContext = context.Background()
+	cancelRun  = func() {}
+)
+
+// requestScope is the context attached to the api requests of one cleanup
+// run, runContext or the context of the running phase when --phase-timeout
+// is set. Each run has its own, the functions of the cleanup take no context
+// since the vendored client-go doesn't, so it is attached at the transport.
+type requestScope struct {
+	sync.Mutex
+	ctx context.Context
+}
+
+func newRequestScope() *requestScope {
+	return &requestScope{ctx: runContext}
+}
+
+func (s *requestScope) set(ctx context.Context) {
+	s.Lock()
+	defer s.Unlock()
+	s.ctx = ctx
+}
+
+// context returns the context of the scope, runContext for a nil scope.
+func (s *requestScope) context() context.Context {
+	if s == nil {
+		return runContext
+	}
+	s.Lock()
+	defer s.Unlock()
+	return s.ctx
+}
+
+// startRunContext sets up runContext for the whole invocation, a second
+// signal exits right away.
+func startRunContext(timeout time.Duration) {
+	if timeout > 0 {
+		runContext, cancelRun = context.WithTimeout(context.Background(), timeout)
+	} else {
+		runContext, cancelRun = context.WithCancel(context.Background())
+	}
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		logrus.Warnf("received %v, cancelling the cleanup, send it again to exit now", sig)
+		cancelRun()
+		<-signals
+		exitHooks.Lock()
+		for _, hook := range exitHooks.hooks {
+			hook()
+		}
+		os.Exit(1)
+	}()
+}
+
+// exitHooks run before a second signal exits right away, which skips the
+// deferred cleanups of the run. They must be safe to run twice.
+var exitHooks struct {
+	sync.Mutex
+	hooks []func()
+}
+
+func atExit(hook func()) {
+	exitHooks.Lock()
+	defer exitHooks.Unlock()
+	exitHooks.hooks = append(exitHooks.hooks, hook)
+}
+
+type contextRoundTripper struct {
+	transport http.RoundTripper
+	scope     *requestScope
+}
+
+func (t *contextRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	// requests with a context of their own, like watches, keep it
+	if req.Context() == context.Background() {
+		req = req.WithContext(t.scope.context())
+	}
+	return t.transport.RoundTrip(req)
+}
+
+// withRunContext makes every request of config fail once the context of
+// scope is done, runContext when scope is nil.
+func withRunContext(config *rest.Config, scope *requestScope) {
+	wrap := config.WrapTransport
+	config.WrapTransport = func(rt http.RoundTripper) http.RoundTripper {
+		if wrap != nil {
+			rt = wrap(rt)
+		}
+		return &contextRoundTripper{transport: rt, scope: scope}
+	}
+}
+
+// sleep waits for d, it returns runContext's error when it is done first.
+func sleep(d time.Duration) error {
+	select {
+	case <-time.After(d):
+		return nil
+	case <-runContext.Done():
+		return runContext.Err()
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"github.com/rancher/norman/types/slice"
+	"github.com/sirupsen/logrus"
+	"k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/dynamic"
+)
+
+// rancherRelease is the name of the helm release rancher is installed as.
+const rancherRelease = "rancher"
+
+// certManagerGroups are the api groups of cert-manager, the legacy one is
+// served by releases before 0.11.
+var certManagerGroups = []string{"cert-manager.io", "certmanager.k8s.io"}
+
+// certManagerResources are the cert-manager resources the rancher chart
+// creates, or ingress-shim creates for the rancher ingress.
+var certManagerResources = []string{"certificates", "issuers", "clusterissuers"}
+
+// isRancherReleaseObject tells objects of the rancher release: created by
+// the chart, or owned by the rancher ingress like ingress-shim certificates.
+func isRancherReleaseObject(obj *unstructured.Unstructured) bool {
+	if obj.GetNamespace() != "" && obj.GetNamespace() != cattleNamespace {
+		return false
+	}
+	labels := obj.GetLabels()
+	if labels["release"] == rancherRelease || labels["app"] == rancherRelease || labels["app.kubernetes.io/instance"] == rancherRelease {
+		return true
+	}
+	if obj.GetAnnotations()["meta.helm.sh/release-name"] == rancherRelease {
+		return true
+	}
+	for _, ref := range obj.GetOwnerReferences() {
+		if ref.Kind == "Ingress" && ref.Name == rancherRelease {
+			return true
+		}
+	}
+	return false
+}
+
+// certManagerCleanup deletes the certificates, issuers and cluster issuers
+// of the rancher release, they would keep renewing the certificate of an
+// ingress that is gone. cert-manager itself and everything else it manages
+// are left in place.
+func certManagerCleanup(apiExtClient clientset.Interface, pool dynamic.ClientPool) error {
+	errs := []error{}
+	for _, group := range certManagerGroups {
+		if !servedGroups.Has(group) {
+			continue
+		}
+		crds, err := getCRDsForGroup(apiExtClient, group)
+		if err != nil {
+			return err
+		}
+		for _, crd := range crds {
+			if !slice.ContainsString(certManagerResources, crd.Spec.Names.Plural) {
+				continue
+			}
+			client, resource, err := getCustomResourceClient(pool, crd)
+			if err != nil {
+				return err
+			}
+			items, err := getCustomResourceList(pool, crd, v1.ListOptions{})
+			if err != nil {
+				return err
+			}
+			for _, item := range items {
+				if !isRancherReleaseObject(&item) || skipNamespace(item.GetNamespace()) {
+					continue
+				}
+				logrus.Infof("deleting %s [%s]..", crd.Spec.Names.Kind, namespacedName(item.GetNamespace(), item.GetName()))
+				err := client.Resource(resource, item.GetNamespace()).Delete(item.GetName(), getDeleteOptions())
+				if err = recordDelete(objectOf(item.GetAPIVersion(), item.GetKind(), &item), err); err != nil {
+					errs = append(errs, err)
+				}
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return cleanupErrors(errs)
+	}
+	return nil
+}
+
+// certManagerPermissions are needed on top of the required ones with
+// --include-cert-manager.
+func certManagerPermissions() []permission {
+	permissions := []permission{}
+	for _, group := range certManagerGroups {
+		if servedGroups.Has(group) {
+			permissions = append(permissions, permission{group, "*", []string{"list", "delete"}})
+		}
+	}
+	return permissions
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/rancher/norman/types/slice"
+	"github.com/sirupsen/logrus"
+	apiextv1beta1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
+	"k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+)
+
+// chartCRDReleases are the releases of charts rancher deployed that install
+// their crds themselves, the other charts ship them in a rancher-<name>-crd
+// release.
+var chartCRDReleases = []string{"rancher-istio", "rancher-backup", "rancher-monitoring", "rancher-logging"}
+
+// chartCRD is a crd installed by a chart rancher deployed along with the
+// number of its custom resources left.
+type chartCRD struct {
+	crd       apiextv1beta1.CustomResourceDefinition
+	release   string
+	remaining int
+}
+
+func chartCRDRelease(crd apiextv1beta1.CustomResourceDefinition) string {
+	release := crd.Annotations["meta.helm.sh/release-name"]
+	if (strings.HasPrefix(release, "rancher-") && strings.HasSuffix(release, "-crd")) || slice.ContainsString(chartCRDReleases, release) {
+		return release
+	}
+	return ""
+}
+
+// getChartCRDs returns the crds of the charts rancher deployed, the ones of
+// cattle groups are removed with rancher anyway.
+func getChartCRDs(apiExtClient clientset.Interface, pool dynamic.ClientPool) ([]chartCRD, error) {
+	crdList, err := apiExtClient.ApiextensionsV1beta1().CustomResourceDefinitions().List(v1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	crds := []chartCRD{}
+	for _, crd := range crdList.Items {
+		release := chartCRDRelease(crd)
+		if release == "" || isCattleGroup(crd.Spec.Group) {
+			continue
+		}
+		items, err := getCustomResourceList(pool, crd, v1.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		crds = append(crds, chartCRD{crd: crd, release: release, remaining: len(items)})
+	}
+	return crds, nil
+}
+
+// chartCRDsCleanup deletes the crds of the charts rancher deployed, see
+// --include-chart-crds. A crd that still has custom resources is kept, they
+// belong to someone once their chart is gone.
+func chartCRDsCleanup(apiExtClient clientset.Interface, pool dynamic.ClientPool) error {
+	crds, err := getChartCRDs(apiExtClient, pool)
+	if err != nil {
+		return err
+	}
+	errs := []error{}
+	for _, c := range crds {
+		if keepCRDs {
+			recordSkip(objectOf("apiextensions.k8s.io/v1beta1", "CustomResourceDefinition", &c.crd), "crds are kept")
+			continue
+		}
+		if c.remaining > 0 {
+			logrus.Warnf("keeping custom resource definition [%s] of chart [%s], %d custom resources remain", c.crd.Name, c.release, c.remaining)
+			recordSkip(objectOf("apiextensions.k8s.io/v1beta1", "CustomResourceDefinition", &c.crd), fmt.Sprintf("%d custom resources remain", c.remaining))
+			continue
+		}
+		logrus.Infof("deleting custom resource definition [%s] of chart [%s]..", c.crd.Name, c.release)
+		err := apiExtClient.ApiextensionsV1beta1().CustomResourceDefinitions().Delete(c.crd.Name, getDeleteOptions())
+		if err = recordDelete(objectOf("apiextensions.k8s.io/v1beta1", "CustomResourceDefinition", &c.crd), err); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return cleanupErrors(errs)
+	}
+	return nil
+}
+
+// printChartCRDs lists the chart crds the plan removes and the ones it keeps
+// because custom resources remain.
+func printChartCRDs(w io.Writer, crds []chartCRD) {
+	fmt.Fprintln(w, "chart crds:")
+	for _, c := range crds {
+		if keepCRDs {
+			fmt.Fprintf(w, "  %s (%s) [kept]\n", c.crd.Name, c.release)
+			continue
+		}
+		if c.remaining > 0 {
+			fmt.Fprintf(w, "  %s (%s) [kept, %d custom resources remain]\n", c.crd.Name, c.release, c.remaining)
+			continue
+		}
+		fmt.Fprintf(w, "  %s (%s)\n", c.crd.Name, c.release)
+	}
+}
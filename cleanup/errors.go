@@ -0,0 +1,139 @@
+// Package cleanup holds the types the outcome of a rancher cleanup is
+// reported with, so tools embedding rmrancher can inspect its failures.
+package cleanup
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// the results of the change to an object.
+const (
+	ResultDeleted = "deleted"
+	ResultUpdated = "updated"
+	ResultSkipped = "skipped"
+	ResultFailed  = "failed"
+)
+
+// Object identifies an object, or a collection of objects when deleted by
+// selector.
+type Object struct {
+	APIVersion      string `json:"apiVersion"`
+	Kind            string `json:"kind"`
+	Namespace       string `json:"namespace,omitempty"`
+	Name            string `json:"name,omitempty"`
+	Selector        string `json:"selector,omitempty"`
+	UID             string `json:"uid,omitempty"`
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+	// Context is the kubeconfig context of the cluster the object is in.
+	Context string `json:"context,omitempty"`
+}
+
+// ObjectError is the failure to delete or update a single object.
+type ObjectError struct {
+	Object
+	// Action is the result the change was meant to have, ResultDeleted or
+	// ResultUpdated.
+	Action string
+	Err    error
+}
+
+func (e *ObjectError) Error() string {
+	name := e.Name
+	if name == "" {
+		name = "-l " + e.Selector
+	}
+	if e.Namespace != "" {
+		name = e.Namespace + "/" + name
+	}
+	return fmt.Sprintf("%s %s [%s]: %v", strings.TrimSuffix(e.Action, "d"), e.Kind, name, e.Err)
+}
+
+// GroupVersionKind returns the kind of the object that failed.
+func (e *ObjectError) GroupVersionKind() schema.GroupVersionKind {
+	return schema.FromAPIVersionAndKind(e.APIVersion, e.Kind)
+}
+
+// Retryable reports whether the failure is transient, conflicts, timeouts and
+// throttling usually go away on the next pass.
+func (e *ObjectError) Retryable() bool {
+	return errors.IsConflict(e.Err) || errors.IsServerTimeout(e.Err) || errors.IsTimeout(e.Err) ||
+		errors.IsTooManyRequests(e.Err) || errors.IsServiceUnavailable(e.Err) || errors.IsInternalError(e.Err)
+}
+
+// Errors aggregates the failures of a cleanup step, other than object
+// failures it may hold list errors and nested Errors.
+type Errors []error
+
+func (e Errors) Error() string {
+	msgs := []string{}
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return fmt.Sprintf("%d errors: %s", len(e), strings.Join(msgs, "; "))
+}
+
+// Objects returns the object failures, flattening nested Errors.
+func (e Errors) Objects() []*ObjectError {
+	objects := []*ObjectError{}
+	for _, err := range e {
+		switch err := err.(type) {
+		case *ObjectError:
+			objects = append(objects, err)
+		case Errors:
+			objects = append(objects, err.Objects()...)
+		}
+	}
+	return objects
+}
+
+// Retryable reports whether every failure is a retryable object failure.
+func (e Errors) Retryable() bool {
+	objects := e.Objects()
+	if len(objects) == 0 || len(objects) != e.Len() {
+		return false
+	}
+	for _, object := range objects {
+		if !object.Retryable() {
+			return false
+		}
+	}
+	return true
+}
+
+// Len counts the failures, flattening nested Errors.
+func (e Errors) Len() int {
+	n := 0
+	for _, err := range e {
+		if nested, ok := err.(Errors); ok {
+			n += nested.Len()
+			continue
+		}
+		n++
+	}
+	return n
+}
+
+// IsTimeout reports whether err, or any failure it aggregates, is an api
+// request that timed out.
+func IsTimeout(err error) bool {
+	switch err := err.(type) {
+	case *ObjectError:
+		return IsTimeout(err.Err)
+	case Errors:
+		for _, nested := range err {
+			if IsTimeout(nested) {
+				return true
+			}
+		}
+		return false
+	case net.Error:
+		return err.Timeout()
+	}
+	return err == context.DeadlineExceeded || errors.IsTimeout(err) || errors.IsServerTimeout(err)
+}
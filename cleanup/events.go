@@ -0,0 +1,64 @@
+package cleanup
+
+import "sync"
+
+// Events lets code embedding the cleanup follow its progress without
+// scraping the logs, see SetEvents. Every callback is optional and called
+// synchronously.
+type Events struct {
+	OnPhaseStart    func(phase string)
+	OnObjectDeleted func(obj Object)
+	OnObjectUpdated func(obj Object)
+	OnObjectSkipped func(obj Object, reason string)
+	OnError         func(err *ObjectError)
+}
+
+var (
+	eventsLock sync.RWMutex
+	events     = &Events{}
+)
+
+// SetEvents makes e receive the progress of the cleanups run from now on,
+// nil stops the reports.
+func SetEvents(e *Events) {
+	if e == nil {
+		e = &Events{}
+	}
+	eventsLock.Lock()
+	defer eventsLock.Unlock()
+	events = e
+}
+
+// CurrentEvents returns the events receiving the progress of the cleanup.
+func CurrentEvents() *Events {
+	eventsLock.RLock()
+	defer eventsLock.RUnlock()
+	return events
+}
+
+// PhaseStart reports the start of phase.
+func (e *Events) PhaseStart(phase string) {
+	if e.OnPhaseStart != nil {
+		e.OnPhaseStart(phase)
+	}
+}
+
+// Result reports the result of the change to obj, failures are reported
+// through Error.
+func (e *Events) Result(obj Object, result, reason string) {
+	switch {
+	case result == ResultDeleted && e.OnObjectDeleted != nil:
+		e.OnObjectDeleted(obj)
+	case result == ResultUpdated && e.OnObjectUpdated != nil:
+		e.OnObjectUpdated(obj)
+	case result == ResultSkipped && e.OnObjectSkipped != nil:
+		e.OnObjectSkipped(obj, reason)
+	}
+}
+
+// Error reports the failure to change an object.
+func (e *Events) Error(err *ObjectError) {
+	if e.OnError != nil {
+		e.OnError(err)
+	}
+}
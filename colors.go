@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	colorRed    = 31
+	colorGreen  = 32
+	colorYellow = 33
+)
+
+// messageColors color the info messages by what they tell: deletions are
+// red, skips yellow and verifications green.
+var messageColors = []struct {
+	prefix string
+	color  int
+}{
+	{"deleting ", colorRed},
+	{"deleted ", colorRed},
+	{"removing ", colorRed},
+	{"keeping ", colorYellow},
+	{"skipping ", colorYellow},
+	{"preserving ", colorYellow},
+	{"no ", colorGreen},
+	{"kubernetes version ", colorGreen},
+	{"cleanup done ", colorGreen},
+}
+
+// colorFormatter is the text formatter with the info messages colored by
+// messageColors.
+type colorFormatter struct {
+	logrus.TextFormatter
+}
+
+func (f *colorFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	if entry.Level == logrus.InfoLevel {
+		for _, c := range messageColors {
+			if strings.HasPrefix(entry.Message, c.prefix) {
+				colored := *entry
+				colored.Message = fmt.Sprintf("\x1b[%dm%s\x1b[0m", c.color, entry.Message)
+				return f.TextFormatter.Format(&colored)
+			}
+		}
+	}
+	return f.TextFormatter.Format(entry)
+}
+
+// setupColors colors the log when stderr is a terminal, unless --no-color or
+// NO_COLOR say otherwise.
+func setupColors(noColor bool) {
+	if noColor || os.Getenv("NO_COLOR") != "" || !logrus.IsTerminal() {
+		logrus.SetFormatter(&logrus.TextFormatter{DisableColors: true})
+		return
+	}
+	logrus.SetFormatter(&colorFormatter{})
+}
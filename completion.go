@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const bashCompletion = `_rmrancher() {
+	local cur=${COMP_WORDS[COMP_CWORD]}
+	COMPREPLY=( $(compgen -W "$("${COMP_WORDS[@]:0:$COMP_CWORD}" --generate-bash-completion 2>/dev/null)" -- "$cur") )
+}
+complete -o default -F _rmrancher rmrancher
+`
+
+const zshCompletion = `autoload -U +X bashcompinit && bashcompinit
+` + bashCompletion
+
+const fishCompletion = `complete -c rmrancher -f -a '(eval (commandline -opc) --generate-bash-completion 2>/dev/null)'
+`
+
+// flagValueCompletions complete the values of flags, from the kubeconfig or
+// the cluster where needed.
+var flagValueCompletions = map[string]func(args []string) []string{
+	"--only": func([]string) []string { return phases },
+	"--propagation-policy": func([]string) []string {
+		return []string{"background", "foreground", "orphan"}
+	},
+	"--output":            func([]string) []string { return []string{"text", "script"} },
+	"-o":                  func([]string) []string { return []string{"text", "script"} },
+	"--context":           completeContexts,
+	"--contexts":          completeContexts,
+	"--namespace":         completeNamespaces,
+	"-n":                  completeNamespaces,
+	"--target-namespaces": completeNamespaces,
+}
+
+func doCompletion(ctx *cli.Context) error {
+	switch shell := ctx.Args().First(); shell {
+	case "bash":
+		fmt.Print(bashCompletion)
+	case "zsh":
+		fmt.Print(zshCompletion)
+	case "fish":
+		fmt.Print(fishCompletion)
+	default:
+		return fmt.Errorf("invalid shell [%s], must be one of bash|zsh|fish", shell)
+	}
+	return nil
+}
+
+// completeFlagValue prints the completions of the value of the flag right
+// before --generate-bash-completion in args. It reports false when there is
+// no such flag, the flag parser would take the completion flag for its value.
+func completeFlagValue(args []string) bool {
+	if len(args) < 2 || args[len(args)-1] != "--"+cli.BashCompletionFlag.Name {
+		return false
+	}
+	complete, ok := flagValueCompletions[args[len(args)-2]]
+	if !ok {
+		return false
+	}
+	for _, value := range complete(args) {
+		fmt.Println(value)
+	}
+	return true
+}
+
+// completeFlags returns a completion func listing flags, and the commands of
+// the app when withCommands is set.
+func completeFlags(flags []cli.Flag, withCommands bool) cli.BashCompleteFunc {
+	return func(ctx *cli.Context) {
+		if withCommands {
+			cli.DefaultAppComplete(ctx)
+		}
+		for _, flag := range flags {
+			name := strings.Split(flag.GetName(), ",")[0]
+			fmt.Println("--" + name)
+		}
+	}
+}
+
+// completionKubeconfig returns the kubeconfig passed in args, or from the
+// environment.
+func completionKubeconfig(args []string) string {
+	for i, arg := range args[:len(args)-1] {
+		if arg == "--kubeconfig" || arg == "-c" {
+			return args[i+1]
+		}
+		if strings.HasPrefix(arg, "--kubeconfig=") {
+			return strings.TrimPrefix(arg, "--kubeconfig=")
+		}
+	}
+	return os.Getenv("KUBECONFIG")
+}
+
+func completeContexts(args []string) []string {
+	kubeConfig, err := clientcmd.LoadFromFile(completionKubeconfig(args))
+	if err != nil {
+		return nil
+	}
+	contexts := []string{}
+	for name := range kubeConfig.Contexts {
+		contexts = append(contexts, name)
+	}
+	sort.Strings(contexts)
+	return contexts
+}
+
+func completeNamespaces(args []string) []string {
+	config, err := loadRestConfig(completionKubeconfig(args), "")
+	if err != nil {
+		return nil
+	}
+	config.Timeout = 5 * time.Second
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil
+	}
+	nsList, err := client.CoreV1().Namespaces().List(v1.ListOptions{})
+	if err != nil {
+		return nil
+	}
+	namespaces := []string{}
+	for _, ns := range nsList.Items {
+		namespaces = append(namespaces, ns.Name)
+	}
+	return namespaces
+}
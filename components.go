@@ -0,0 +1,469 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+	apiextv1beta1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
+	"k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+// component describes the footprint of an optional rancher component that
+// is only removed when explicitly requested.
+type component struct {
+	name       string
+	namespaces []string
+	// namespacePrefixes match namespaces the component creates per project
+	// or cluster, on top of namespaces.
+	namespacePrefixes []string
+	crdGroups         []string
+	// prefixes matches the names of the cluster roles, cluster role bindings
+	// and webhook configurations installed by the component.
+	prefixes []string
+	// release is the helm release of a component whose crd groups are shared
+	// with installs rancher didn't make. Only the custom resources of the
+	// release, or matching selectors, are removed then, and its crds only
+	// once no others are left in them.
+	release string
+	// selectors match the custom resources the component stamped into other
+	// namespaces.
+	selectors []string
+	// deployments are the operator deployments of the component in the
+	// rancher namespace, they are stopped before anything else is removed.
+	deployments []string
+	// preflight, if set, runs before anything of the component is removed.
+	preflight func(apiExtClient clientset.Interface, pool dynamic.ClientPool) error
+}
+
+var monitoringComponent = component{
+	name:       "monitoring",
+	namespaces: []string{"cattle-monitoring-system", "cattle-prometheus"},
+	crdGroups:  []string{"monitoring.coreos.com"},
+	prefixes:   []string{"rancher-monitoring"},
+	release:    "rancher-monitoring",
+	selectors: []string{
+		"release=rancher-monitoring",
+		"io.cattle.field/appId=cluster-monitoring",
+		"io.cattle.field/appId=project-monitoring",
+	},
+}
+
+var loggingComponent = component{
+	name:       "logging",
+	namespaces: []string{"cattle-logging-system", "cattle-logging"},
+	crdGroups:  []string{"logging.banzaicloud.io"},
+	prefixes:   []string{"rancher-logging"},
+	release:    "rancher-logging",
+	selectors:  []string{"app.kubernetes.io/instance=rancher-logging"},
+}
+
+var istioComponent = component{
+	name:       "istio",
+	namespaces: []string{"istio-system", "cattle-istio", "cattle-istio-system"},
+	crdGroups: []string{
+		"authentication.istio.io",
+		"config.istio.io",
+		"install.istio.io",
+		"networking.istio.io",
+		"rbac.istio.io",
+		"security.istio.io",
+		"telemetry.istio.io",
+	},
+	prefixes:  []string{"rancher-istio", "rancher-kiali"},
+	release:   "rancher-istio",
+	selectors: []string{"app.kubernetes.io/instance=rancher-istio"},
+}
+
+// cisComponent is owned by rancher itself and is always removed.
+var cisComponent = component{
+	name:       "cis benchmark",
+	namespaces: []string{"cis-operator-system"},
+	crdGroups:  []string{"cis.cattle.io"},
+	prefixes:   []string{"cis-operator", "rancher-cis-benchmark"},
+}
+
+// backupComponent is owned by rancher itself and is always removed.
+var backupComponent = component{
+	name:       "backup",
+	namespaces: []string{"cattle-resources-system"},
+	crdGroups:  []string{"resources.cattle.io"},
+	prefixes:   []string{"rancher-backup", "rancher-resource-set"},
+	preflight:  warnInProgressBackups,
+}
+
+// the hosted cluster operators are owned by rancher itself and are always
+// removed.
+var eksComponent = component{
+	name:        "eks operator",
+	crdGroups:   []string{"eks.cattle.io"},
+	prefixes:    []string{"eks-operator"},
+	deployments: []string{"eks-config-operator"},
+}
+
+var aksComponent = component{
+	name:        "aks operator",
+	crdGroups:   []string{"aks.cattle.io"},
+	prefixes:    []string{"aks-operator"},
+	deployments: []string{"aks-config-operator"},
+}
+
+var gkeComponent = component{
+	name:        "gke operator",
+	crdGroups:   []string{"gke.cattle.io"},
+	prefixes:    []string{"gke-operator"},
+	deployments: []string{"gke-config-operator"},
+}
+
+// rancherOperatorComponent is the separate operator rancher 2.5 installed, it
+// is left behind on installs upgraded through 2.5.
+var rancherOperatorComponent = component{
+	name:       "rancher operator",
+	namespaces: []string{"rancher-operator-system"},
+	crdGroups:  []string{"rancher.cattle.io"},
+	prefixes:   []string{"rancher-operator"},
+}
+
+// removedComponents are the components removed by the current run, see
+// getComponents.
+var removedComponents []component
+
+// getComponents returns the components removed by the cleanup, the ones
+// owned by rancher, the detected satellites and the ones included by flags.
+func getComponents(ctx *cli.Context, client *kubernetes.Clientset) ([]component, error) {
+	components := []component{
+		cisComponent,
+		eksComponent,
+		aksComponent,
+		gkeComponent,
+		rancherOperatorComponent,
+	}
+	if !snapshotKeepsBackup(ctx) {
+		components = append(components, backupComponent)
+	}
+	if ctx.Bool("include-monitoring") {
+		components = append(components, monitoringComponent)
+	}
+	if ctx.Bool("include-logging") {
+		components = append(components, loggingComponent)
+	}
+	if ctx.Bool("include-istio") {
+		components = append(components, istioComponent)
+	}
+	if ctx.Bool("include-neuvector") {
+		components = append(components, neuvectorComponent)
+	}
+	detected, err := detectComponents(client, satelliteComponents)
+	if err != nil {
+		return nil, err
+	}
+	components = append(components, detected...)
+	if ctx.Bool("include-longhorn") {
+		components = append(components, longhornComponent)
+	}
+	return components, nil
+}
+
+// satelliteComponents catalogs the optional components rancher installs into
+// their own cattle namespaces, they are removed whenever they are detected.
+// Adding a footprint only takes a new entry here.
+var satelliteComponents = []component{
+	{
+		name:       "csp adapter",
+		namespaces: []string{"cattle-csp-adapter-system"},
+		prefixes:   []string{"rancher-csp-adapter"},
+	},
+	{
+		name:       "sriov",
+		namespaces: []string{"cattle-sriov-system"},
+		crdGroups:  []string{"sriovnetwork.openshift.io"},
+		prefixes:   []string{"sriov-network-operator", "rancher-sriov"},
+	},
+	{
+		name:       "elemental",
+		namespaces: []string{"cattle-elemental-system"},
+		crdGroups:  []string{"elemental.cattle.io"},
+		prefixes:   []string{"elemental-operator"},
+	},
+	{
+		// legacy project monitoring deploys a prometheus per project
+		name:              "project monitoring",
+		namespacePrefixes: []string{"cattle-prometheus-p-"},
+		prefixes:          []string{"project-monitoring", "prometheus-project-monitoring"},
+	},
+	{
+		name:       "ui plugins",
+		namespaces: []string{"cattle-ui-plugin-system"},
+		prefixes:   []string{"ui-plugin-operator"},
+	},
+}
+
+// detectComponents returns the components of catalog that have a namespace
+// or a served cattle crd group in the cluster.
+func detectComponents(client *kubernetes.Clientset, catalog []component) ([]component, error) {
+	namespaces, err := getNamespacesList(client)
+	if err != nil {
+		return nil, err
+	}
+	existing := sets.NewString(namespaces...)
+	detected := []component{}
+	for _, c := range catalog {
+		if existing.HasAny(c.namespaces...) || len(c.matchingNamespaces(namespaces)) > 0 || servedGroups.HasAny(c.cattleGroups()...) {
+			logrus.Infof("detected rancher %s", c.name)
+			detected = append(detected, c)
+		}
+	}
+	return detected, nil
+}
+
+// longhornComponent carries cattle labels when installed through rancher, it
+// is left untouched unless explicitly included.
+var longhornComponent = component{
+	name:       "longhorn",
+	namespaces: []string{"longhorn-system"},
+	crdGroups:  []string{"longhorn.io"},
+	prefixes:   []string{"longhorn"},
+}
+
+var neuvectorComponent = component{
+	name:       "neuvector",
+	namespaces: []string{"cattle-neuvector-system"},
+	crdGroups:  []string{"neuvector.com"},
+	prefixes:   []string{"neuvector"},
+}
+
+const admissionAPIVersion = "admissionregistration.k8s.io/v1beta1"
+
+// cattleGroups are the crd groups of the component that only rancher
+// serves, the others may belong to an upstream install of the same operator
+// and don't tell the component is there.
+func (c component) cattleGroups() []string {
+	groups := []string{}
+	for _, group := range c.crdGroups {
+		if strings.HasSuffix(group, ".cattle.io") {
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
+
+func (c component) matches(name string) bool {
+	for _, prefix := range c.prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchingNamespaces returns the namespaces matching the namespace prefixes
+// of the component.
+func (c component) matchingNamespaces(namespaces []string) []string {
+	matching := []string{}
+	for _, namespace := range namespaces {
+		if hasAnyPrefix(namespace, c.namespacePrefixes) {
+			matching = append(matching, namespace)
+		}
+	}
+	return matching
+}
+
+func componentCleanup(client *kubernetes.Clientset, apiExtClient clientset.Interface, pool dynamic.ClientPool, c component) error {
+	logrus.Infof("removing rancher %s..", c.name)
+	if c.preflight != nil {
+		if err := c.preflight(apiExtClient, pool); err != nil {
+			return err
+		}
+	}
+	if !skipNamespace(cattleNamespace) {
+		for _, name := range c.deployments {
+			logrus.Infof("deleting deployment [%s/%s]..", cattleNamespace, name)
+			err := client.AppsV1().Deployments(cattleNamespace).Delete(name, getDeleteOptions())
+			if err = recordDelete(namedObject("apps/v1", "Deployment", cattleNamespace, name), err); err != nil {
+				return err
+			}
+		}
+	}
+	if targetsClusterScope() {
+		if err := componentWebhooksCleanup(client, c); err != nil {
+			return err
+		}
+	}
+	for _, group := range c.crdGroups {
+		if !servedGroups.Has(group) {
+			logrus.Debugf("%s is not served, skipping", group)
+			continue
+		}
+		if c.release != "" {
+			if err := releaseResourcesCleanup(apiExtClient, pool, group, c); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := crdsCleanup(apiExtClient, pool, group); err != nil {
+			return err
+		}
+	}
+	if targetsClusterScope() {
+		if err := componentRBACCleanup(client, c); err != nil {
+			return err
+		}
+	}
+	namespaces := c.namespaces
+	if len(c.namespacePrefixes) > 0 {
+		existing, err := getNamespacesList(client)
+		if err != nil {
+			return err
+		}
+		namespaces = append(append([]string{}, namespaces...), c.matchingNamespaces(existing)...)
+	}
+	for _, namespace := range namespaces {
+		logrus.Infof("deleting namespace [%s]..", namespace)
+		if err := deleteNamespace(client, namespace); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// ownsResource tells the custom resources of the release of c, or matching
+// its selectors, from the ones of other installs in its crd groups.
+func (c component) ownsResource(obj *unstructured.Unstructured) bool {
+	if obj.GetAnnotations()["meta.helm.sh/release-name"] == c.release {
+		return true
+	}
+	for _, selector := range c.selectors {
+		if parsed, err := labels.Parse(selector); err == nil && parsed.Matches(labels.Set(obj.GetLabels())) {
+			return true
+		}
+	}
+	return false
+}
+
+// ownsCRD tells whether crd was installed by the release of c, or its crd
+// release.
+func (c component) ownsCRD(crd apiextv1beta1.CustomResourceDefinition) bool {
+	release := crd.Annotations["meta.helm.sh/release-name"]
+	return release == c.release || release == c.release+"-crd"
+}
+
+// releaseResourcesCleanup deletes the custom resources of group owned by c
+// from every namespace, and the crds of its release once no other custom
+// resources are left in them.
+func releaseResourcesCleanup(apiExtClient clientset.Interface, pool dynamic.ClientPool, group string, c component) error {
+	keep := func(obj *unstructured.Unstructured) (bool, string) {
+		return !c.ownsResource(obj), ""
+	}
+	keepCRD := func(crd apiextv1beta1.CustomResourceDefinition) string {
+		if !c.ownsCRD(crd) {
+			return "not installed by release " + c.release
+		}
+		return ""
+	}
+	return filteredCRDsCleanup(apiExtClient, pool, group, keep, keepCRD)
+}
+
+func componentWebhooksCleanup(client *kubernetes.Clientset, c component) error {
+	validating, err := client.AdmissionregistrationV1beta1().ValidatingWebhookConfigurations().List(v1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for _, webhook := range validating.Items {
+		if !c.matches(webhook.Name) {
+			continue
+		}
+		logrus.Infof("deleting validating webhook configuration [%s]..", webhook.Name)
+		err := client.AdmissionregistrationV1beta1().ValidatingWebhookConfigurations().Delete(webhook.Name, getDeleteOptions())
+		if err = recordDelete(objectOf(admissionAPIVersion, "ValidatingWebhookConfiguration", &webhook), err); err != nil {
+			return err
+		}
+	}
+	mutating, err := client.AdmissionregistrationV1beta1().MutatingWebhookConfigurations().List(v1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for _, webhook := range mutating.Items {
+		if !c.matches(webhook.Name) {
+			continue
+		}
+		logrus.Infof("deleting mutating webhook configuration [%s]..", webhook.Name)
+		err := client.AdmissionregistrationV1beta1().MutatingWebhookConfigurations().Delete(webhook.Name, getDeleteOptions())
+		if err = recordDelete(objectOf(admissionAPIVersion, "MutatingWebhookConfiguration", &webhook), err); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func componentRBACCleanup(client *kubernetes.Clientset, c component) error {
+	crbList, err := client.RbacV1().ClusterRoleBindings().List(v1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for _, crb := range crbList.Items {
+		if !c.matches(crb.Name) {
+			continue
+		}
+		logrus.Infof("deleting cluster role binding [%s]..", crb.Name)
+		if err := deleteClusterRoleBinding(client, crb.Name); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+	}
+	crList, err := client.RbacV1().ClusterRoles().List(v1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for _, cr := range crList.Items {
+		if !c.matches(cr.Name) {
+			continue
+		}
+		logrus.Infof("deleting cluster role [%s]..", cr.Name)
+		if err := deleteClusterRole(client, cr.Name); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// warnInProgressBackups warns about rancher-backup Backups that have not
+// completed yet, their result will be lost once the operator is removed.
+func warnInProgressBackups(apiExtClient clientset.Interface, pool dynamic.ClientPool) error {
+	crds, err := getCRDsForGroup(apiExtClient, "resources.cattle.io")
+	if err != nil {
+		return err
+	}
+	for _, crd := range crds {
+		if crd.Spec.Names.Plural != "backups" {
+			continue
+		}
+		backups, err := getCustomResourceList(pool, crd, v1.ListOptions{})
+		if err != nil {
+			return err
+		}
+		for _, backup := range backups {
+			if !isConditionTrue(backup.Object, "Ready") {
+				logrus.Warnf("backup [%s] is still in progress and will be interrupted", backup.GetName())
+			}
+		}
+	}
+	return nil
+}
+
+func isConditionTrue(obj map[string]interface{}, conditionType string) bool {
+	conditions, _, _ := unstructured.NestedSlice(obj, "status", "conditions")
+	for _, c := range conditions {
+		condition, ok := c.(map[string]interface{})
+		if !ok || condition["type"] != conditionType {
+			continue
+		}
+		return condition["status"] == "True"
+	}
+	return false
+}
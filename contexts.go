@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// kubeContext is the kubeconfig context the cleanup currently runs against,
+// --context or the current context of the kubeconfig when empty.
+var kubeContext string
+
+// inDownstreamContext is set while the downstream contexts are cleaned up,
+// --server and --certificate-authority only apply to the management context.
+var inDownstreamContext bool
+
+// doRemoveRancherContexts runs the cleanup on the management context and
+// then on every downstream context, see --contexts and --all-contexts. The
+// report covers all of them.
+func doRemoveRancherContexts(ctx *cli.Context) error {
+	if ctx.Bool("quiet") {
+		logrus.SetLevel(logrus.WarnLevel)
+	}
+	defer func() {
+		fmt.Fprintln(os.Stderr, report.summary())
+	}()
+	kubeContext = ctx.GlobalString("context")
+	downstream, err := getDownstreamContexts(ctx)
+	if err != nil {
+		return err
+	}
+	if len(downstream) == 0 {
+		return doRemoveRancher(ctx)
+	}
+	logrus.Infof("cleaning up management context [%s]..", kubeContext)
+	if err := doRemoveRancher(ctx); err != nil {
+		return fmt.Errorf("management context [%s]: %v", kubeContext, err)
+	}
+	inDownstreamContext = true
+	defer func() {
+		inDownstreamContext = false
+	}()
+	errs := []error{}
+	for _, name := range downstream {
+		kubeContext = name
+		logrus.Infof("cleaning up downstream context [%s]..", name)
+		if err := doRemoveRancher(ctx); err != nil {
+			logrus.Errorf("failed to clean up context [%s]: %v", name, err)
+			// object failures carry their context already
+			if _, ok := err.(cleanupErrors); !ok {
+				err = fmt.Errorf("context [%s]: %v", name, err)
+			}
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return cleanupErrors(errs)
+	}
+	return nil
+}
+
+// getDownstreamContexts returns the contexts to clean up after the management
+// context, which is resolved into kubeContext.
+func getDownstreamContexts(ctx *cli.Context) ([]string, error) {
+	contexts := ctx.GlobalStringSlice("contexts")
+	if len(contexts) == 0 && !ctx.GlobalBool("all-contexts") {
+		return nil, nil
+	}
+	kubeConfig, err := getClientConfig(ctx.GlobalString("kubeconfig"), kubeContext).RawConfig()
+	if err != nil {
+		return nil, err
+	}
+	if len(kubeConfig.Contexts) == 0 {
+		return nil, fmt.Errorf("--contexts and --all-contexts need a kubeconfig")
+	}
+	if kubeContext == "" {
+		kubeContext = kubeConfig.CurrentContext
+	}
+	if _, ok := kubeConfig.Contexts[kubeContext]; !ok {
+		return nil, fmt.Errorf("management context [%s] not found in the kubeconfig", kubeContext)
+	}
+	if ctx.GlobalBool("all-contexts") {
+		contexts = nil
+		for name := range kubeConfig.Contexts {
+			contexts = append(contexts, name)
+		}
+		sort.Strings(contexts)
+	}
+	downstream := []string{}
+	for _, name := range contexts {
+		if name == kubeContext {
+			continue
+		}
+		if _, ok := kubeConfig.Contexts[name]; !ok {
+			return nil, fmt.Errorf("context [%s] not found in the kubeconfig", name)
+		}
+		downstream = append(downstream, name)
+	}
+	return downstream, nil
+}
+
+// unsafeFileChars are the characters of a context name not kept in the name
+// of its backup file.
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// contextBackupFile is where --backup-file is written for a downstream
+// context, the context name goes before the extension so every context of
+// the run gets its own backup.
+func contextBackupFile(path, context string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "." + unsafeFileChars.ReplaceAllString(context, "_") + ext
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// doRunController runs the cleanup over and over until nothing it removes is
+// left, kept clusters and users and the crds left in place do not count. It
+// fails with what remains once a successful pass no longer changes that.
+func doRunController(ctx *cli.Context) error {
+	interval := ctx.Duration("interval")
+	restConfig, err := getRestConfig(ctx, nil)
+	if err != nil {
+		return err
+	}
+	dynamicClientPool, err := newClientPool(restConfig)
+	if err != nil {
+		return err
+	}
+	var last sets.String
+	for pass := 1; ; pass++ {
+		logrus.Infof("starting cleanup pass %d..", pass)
+		if err := doRemoveRancher(ctx); err != nil {
+			logrus.Errorf("cleanup pass %d failed, retrying in %v: %v", pass, interval, err)
+			last = nil
+			if err := sleep(interval); err != nil {
+				return err
+			}
+			continue
+		}
+		inv, err := takeInventory(dynamicClientPool)
+		if err != nil {
+			logrus.Errorf("failed to take the rancher footprint, retrying in %v: %v", interval, err)
+			last = nil
+			if err := sleep(interval); err != nil {
+				return err
+			}
+			continue
+		}
+		footprint := inv.removableFootprint()
+		if footprint.Len() == 0 {
+			logrus.Infof("cleanup done after %d passes, no removable rancher objects left", pass)
+			return nil
+		}
+		if last != nil && last.Equal(footprint) {
+			for _, obj := range footprint.List() {
+				logrus.Errorf("left in place: %s", obj)
+			}
+			return fmt.Errorf("cleanup stopped making progress after %d passes, %d rancher objects remain", pass, footprint.Len())
+		}
+		last = footprint
+		if err := sleep(interval); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,579 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/rancher/norman/types/slice"
+	"github.com/sirupsen/logrus"
+	apiextv1beta1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
+	"k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+const managementGroup = "management.cattle.io"
+
+// managementResources are the management.cattle.io resources purged before
+// projects, clusters and users are removed.
+var managementResources = []string{
+	"clusterscans",
+	"features",
+	"kontainerdrivers",
+	"nodedrivers",
+	// created for node drivers, they block the removal of the group
+	"dynamicschemas",
+	// alerting
+	"notifiers",
+	"clusteralerts",
+	"clusteralertgroups",
+	"clusteralertrules",
+	"projectalerts",
+	"projectalertgroups",
+	"projectalertrules",
+}
+
+// authTokenResources are the management.cattle.io resources holding login
+// and api tokens, or the artifacts of a provider login, purged once the users
+// are gone.
+var authTokenResources = []string{
+	"tokens",
+	"samltokens",
+}
+
+// authGroupResources are the management.cattle.io resources synced from the
+// groups of external auth providers like active directory, ldap and oidc.
+var authGroupResources = []string{
+	"groups",
+	"groupmembers",
+}
+
+const projectGroup = "project.cattle.io"
+
+// projectResources are the project.cattle.io resources purged before the
+// project namespaces are removed, their finalizers would block it.
+var projectResources = []string{
+	"apps",
+	"apprevisions",
+	// legacy pipelines
+	"pipelines",
+	"pipelineexecutions",
+	"pipelinesettings",
+	"sourcecodecredentials",
+	"sourcecodeproviderconfigs",
+	"sourcecoderepositories",
+}
+
+// provisioningGroups are the api groups of the rancher 2.6+ provisioning v2
+// stack in deletion order, provisioning clusters go first so the rke
+// clusters, control planes, bootstraps and machines they own follow.
+var provisioningGroups = []string{
+	"provisioning.cattle.io",
+	"rke.cattle.io",
+	"rke-machine.cattle.io",
+	"rke-machine-config.cattle.io",
+}
+
+// provisioningClusterLabels name the provisioning cluster the objects of the
+// provisioning v2 and cluster api stacks belong to.
+var provisioningClusterLabels = []string{"cluster.x-k8s.io/cluster-name", "rke.cattle.io/cluster-name"}
+
+// provisioningKeeper tells the provisioning v2 and cluster api objects of
+// kept clusters apart. A provisioning cluster is kept when the management
+// cluster it backs is, the objects named like it or labeled with its name in
+// its namespace go with it.
+type provisioningKeeper struct {
+	clusters sets.String
+}
+
+func newProvisioningKeeper(client clientset.Interface, pool dynamic.ClientPool) (*provisioningKeeper, error) {
+	k := &provisioningKeeper{clusters: sets.NewString()}
+	if len(keepClusters) == 0 || !servedGroups.Has(provisioningGroups[0]) {
+		return k, nil
+	}
+	crds, err := getCRDsForGroup(client, provisioningGroups[0])
+	if err != nil {
+		return nil, err
+	}
+	for _, crd := range crds {
+		if crd.Spec.Names.Plural != "clusters" {
+			continue
+		}
+		items, err := getCustomResourceList(pool, crd, v1.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		for i := range items {
+			k.addCluster(&items[i])
+		}
+	}
+	return k, nil
+}
+
+// addCluster adds the provisioning cluster obj when the management cluster
+// it backs is kept.
+func (k *provisioningKeeper) addCluster(obj *unstructured.Unstructured) {
+	if name, _, _ := unstructured.NestedString(obj.Object, "status", "clusterName"); keepClusters[name] {
+		k.clusters.Insert(namespacedName(obj.GetNamespace(), obj.GetName()))
+	}
+}
+
+// keep reports whether obj belongs to a kept cluster.
+func (k *provisioningKeeper) keep(obj *unstructured.Unstructured) (bool, string) {
+	kept := isKept(obj.GetName()) || k.clusters.Has(namespacedName(obj.GetNamespace(), obj.GetName()))
+	for _, label := range provisioningClusterLabels {
+		if name, ok := obj.GetLabels()[label]; ok && k.clusters.Has(namespacedName(obj.GetNamespace(), name)) {
+			kept = true
+		}
+	}
+	if kept {
+		return true, "cluster is kept"
+	}
+	return false, ""
+}
+
+// provisioningCleanup deletes the provisioning v2 custom resources, and their
+// crds once only the objects of kept clusters are left.
+func provisioningCleanup(client clientset.Interface, pool dynamic.ClientPool) error {
+	keeper, err := newProvisioningKeeper(client, pool)
+	if err != nil {
+		return err
+	}
+	for _, group := range provisioningGroups {
+		if !servedGroups.Has(group) {
+			continue
+		}
+		logrus.Infof("removing %s resources..", group)
+		if err := filteredCRDsCleanup(client, pool, group, keeper.keep, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const capiGroup = "cluster.x-k8s.io"
+
+// capiResources are the cluster api resources created by provisioning v2, in
+// dependency order.
+var capiResources = []string{
+	"clusters",
+	"machinedeployments",
+	"machinesets",
+	"machines",
+}
+
+// capiNamespaces are the namespaces rancher creates cluster api objects in,
+// cluster api objects elsewhere belong to someone else.
+var capiNamespaces = []string{"fleet-default", "fleet-local"}
+
+// capiCleanup deletes the cluster api objects rancher created for clusters
+// that are not kept, the crds are left in place since cluster api may be used
+// outside of rancher.
+func capiCleanup(client clientset.Interface, pool dynamic.ClientPool) error {
+	if !servedGroups.Has(capiGroup) {
+		return nil
+	}
+	keeper, err := newProvisioningKeeper(client, pool)
+	if err != nil {
+		return err
+	}
+	crds, err := getCRDsForGroup(client, capiGroup)
+	if err != nil {
+		return err
+	}
+	for _, plural := range capiResources {
+		for _, crd := range crds {
+			if crd.Spec.Names.Plural != plural {
+				continue
+			}
+			if err := capiResourcesCleanup(pool, crd, keeper); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func capiResourcesCleanup(pool dynamic.ClientPool, crd apiextv1beta1.CustomResourceDefinition, keeper *provisioningKeeper) error {
+	client, resource, err := getCustomResourceClient(pool, crd)
+	if err != nil {
+		return err
+	}
+	items, err := getCustomResourceList(pool, crd, v1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	errs := []error{}
+	for _, item := range items {
+		if !slice.ContainsString(capiNamespaces, item.GetNamespace()) || skipNamespace(item.GetNamespace()) {
+			continue
+		}
+		if kept, reason := keeper.keep(&item); kept {
+			recordSkip(objectOf(item.GetAPIVersion(), item.GetKind(), &item), reason)
+			continue
+		}
+		logrus.Infof("deleting %s [%s]..", crd.Spec.Names.Kind, namespacedName(item.GetNamespace(), item.GetName()))
+		if len(item.GetFinalizers()) > 0 && stripFinalizers() {
+			item.SetFinalizers(nil)
+			_, err := client.Resource(resource, item.GetNamespace()).Update(&item)
+			if err = recordUpdate(objectOf(item.GetAPIVersion(), item.GetKind(), &item), err); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+		}
+		err := client.Resource(resource, item.GetNamespace()).Delete(item.GetName(), getDeleteOptions())
+		if err = recordDelete(objectOf(item.GetAPIVersion(), item.GetKind(), &item), err); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return cleanupErrors(errs)
+	}
+	return nil
+}
+
+func managementResourcesCleanup(client clientset.Interface, pool dynamic.ClientPool) error {
+	return groupResourcesCleanup(client, pool, managementGroup, managementResources)
+}
+
+// projectResourcesCleanup deletes the legacy catalog apps, pipelines and
+// source code providers rancher left in the project namespaces.
+func projectResourcesCleanup(client clientset.Interface, pool dynamic.ClientPool) error {
+	if !servedGroups.Has(projectGroup) {
+		return nil
+	}
+	logrus.Infof("removing %s resources..", projectGroup)
+	return groupResourcesCleanup(client, pool, projectGroup, projectResources)
+}
+
+// groupResourcesCleanup deletes every custom resource of group that is one of
+// resources, the crds are left in place.
+func groupResourcesCleanup(client clientset.Interface, pool dynamic.ClientPool, group string, resources []string) error {
+	crds, err := getCRDsForGroup(client, group)
+	if err != nil {
+		return err
+	}
+	for _, crd := range crds {
+		if !slice.ContainsString(resources, crd.Spec.Names.Plural) {
+			continue
+		}
+		if err := customResourcesCleanup(pool, crd, v1.ListOptions{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// authTokensCleanup deletes the tokens that do not belong to a kept user one
+// by one, each of them is a credential and reported as such.
+func authTokensCleanup(client clientset.Interface, pool dynamic.ClientPool) error {
+	crds, err := getCRDsForGroup(client, managementGroup)
+	if err != nil {
+		return err
+	}
+	errs := []error{}
+	for _, crd := range crds {
+		if !slice.ContainsString(authTokenResources, crd.Spec.Names.Plural) {
+			continue
+		}
+		resourceClient, resource, err := getCustomResourceClient(pool, crd)
+		if err != nil {
+			return err
+		}
+		items, err := getCustomResourceList(pool, crd, v1.ListOptions{})
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			if skipNamespace(item.GetNamespace()) || (!resource.Namespaced && !targetsClusterScope()) {
+				continue
+			}
+			if userID, _, _ := unstructured.NestedString(item.Object, "userId"); keepUsers[userID] {
+				recordSkip(objectOf(item.GetAPIVersion(), item.GetKind(), &item), "user is kept")
+				continue
+			}
+			logrus.Infof("deleting %s [%s]..", crd.Spec.Names.Kind, namespacedName(item.GetNamespace(), item.GetName()))
+			if len(item.GetFinalizers()) > 0 && stripFinalizers() {
+				item.SetFinalizers(nil)
+				_, err := resourceClient.Resource(resource, item.GetNamespace()).Update(&item)
+				if err = recordUpdate(objectOf(item.GetAPIVersion(), item.GetKind(), &item), err); err != nil {
+					errs = append(errs, err)
+					continue
+				}
+			}
+			err := resourceClient.Resource(resource, item.GetNamespace()).Delete(item.GetName(), getDeleteOptions())
+			if err = recordCredentialDelete(objectOf(item.GetAPIVersion(), item.GetKind(), &item), err); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return cleanupErrors(errs)
+	}
+	return nil
+}
+
+// getServedGroups returns the names of the api groups served by the cluster.
+func getServedGroups(client *kubernetes.Clientset) (sets.String, error) {
+	groupList, err := client.Discovery().ServerGroups()
+	if err != nil {
+		return nil, err
+	}
+	groups := sets.NewString()
+	for _, group := range groupList.Groups {
+		groups.Insert(group.Name)
+	}
+	return groups, nil
+}
+
+func getCRDsForGroup(client clientset.Interface, group string) ([]apiextv1beta1.CustomResourceDefinition, error) {
+	crdList, err := client.ApiextensionsV1beta1().CustomResourceDefinitions().List(v1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	crds := []apiextv1beta1.CustomResourceDefinition{}
+	for _, crd := range crdList.Items {
+		if crd.Spec.Group == group {
+			crds = append(crds, crd)
+		}
+	}
+	return crds, nil
+}
+
+func getCustomResourceClient(pool dynamic.ClientPool, crd apiextv1beta1.CustomResourceDefinition) (dynamic.Interface, *v1.APIResource, error) {
+	gvk := schema.GroupVersionKind{Group: crd.Spec.Group, Version: crd.Spec.Version, Kind: crd.Spec.Names.Kind}
+	client, resource, err := resourceClient(pool, gvk)
+	if !meta.IsNoMatchError(err) {
+		return client, resource, err
+	}
+	// not served yet or any more, the definition still tells where it was
+	client, err = pool.ClientForGroupVersionKind(gvk)
+	if err != nil {
+		return nil, nil, err
+	}
+	resource = &v1.APIResource{
+		Name:       crd.Spec.Names.Plural,
+		Kind:       crd.Spec.Names.Kind,
+		Namespaced: crd.Spec.Scope == apiextv1beta1.NamespaceScoped,
+	}
+	return client, resource, nil
+}
+
+func getCustomResourceList(pool dynamic.ClientPool, crd apiextv1beta1.CustomResourceDefinition, opts v1.ListOptions) ([]unstructured.Unstructured, error) {
+	client, resource, err := getCustomResourceClient(pool, crd)
+	if err != nil {
+		return nil, err
+	}
+	obj, err := client.Resource(resource, "").List(opts)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	list, ok := obj.(*unstructured.UnstructuredList)
+	if !ok {
+		return nil, fmt.Errorf("unexpected list type %T for %s", obj, crd.Name)
+	}
+	return list.Items, nil
+}
+
+// customResourcesCleanup deletes every custom resource of crd matching opts,
+// finalizers are removed first since the controllers handling them are gone
+// or going away.
+func customResourcesCleanup(pool dynamic.ClientPool, crd apiextv1beta1.CustomResourceDefinition, opts v1.ListOptions) error {
+	client, resource, err := getCustomResourceClient(pool, crd)
+	if err != nil {
+		return err
+	}
+	items, err := getCustomResourceList(pool, crd, opts)
+	if err != nil {
+		return err
+	}
+	errs := []error{}
+	namespaces := sets.NewString()
+	for _, item := range items {
+		if skipNamespace(item.GetNamespace()) {
+			continue
+		}
+		namespaces.Insert(item.GetNamespace())
+		if len(item.GetFinalizers()) > 0 && stripFinalizers() {
+			item.SetFinalizers(nil)
+			_, err := client.Resource(resource, item.GetNamespace()).Update(&item)
+			if err = recordUpdate(objectOf(item.GetAPIVersion(), item.GetKind(), &item), err); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	for _, namespace := range namespaces.List() {
+		logrus.Infof("deleting %s [%s]..", crd.Name, namespacedName(namespace, "*"))
+		err := client.Resource(resource, namespace).DeleteCollection(getDeleteOptions(), opts)
+		if err = recordDelete(selectedObjects(crd.Spec.Group+"/"+crd.Spec.Version, crd.Spec.Names.Kind, namespace, opts.LabelSelector), err); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return cleanupErrors(errs)
+	}
+	return nil
+}
+
+// keepCRDs keeps the custom resource definitions while their custom
+// resources are still purged, see --keep-crds.
+var keepCRDs bool
+
+// customResourcesGoneTimeout bounds the wait for the custom resources of a
+// kept crd to be gone when --object-timeout is not set.
+const customResourcesGoneTimeout = 2 * time.Minute
+
+// waitCustomResourcesGone waits for the custom resources of crd outside the
+// skipped namespaces to be gone, it fails when some remain.
+func waitCustomResourcesGone(pool dynamic.ClientPool, crd apiextv1beta1.CustomResourceDefinition) error {
+	timeout := customResourcesGoneTimeout
+	if objectTimeout > 0 {
+		timeout = objectTimeout
+	}
+	remaining := 0
+	err := wait.PollImmediate(2*time.Second, timeout, func() (bool, error) {
+		items, err := getCustomResourceList(pool, crd, v1.ListOptions{})
+		if err != nil {
+			return false, err
+		}
+		remaining = 0
+		for _, item := range items {
+			if !skipNamespace(item.GetNamespace()) {
+				remaining++
+			}
+		}
+		return remaining == 0, nil
+	})
+	if err == wait.ErrWaitTimeout {
+		return fmt.Errorf("%d %s remain after %v", remaining, crd.Name, timeout)
+	}
+	return err
+}
+
+// filteredCRDsCleanup deletes the custom resources of group outside the
+// skipped namespaces that keep doesn't keep, and the crds of group once none
+// of their custom resources are left. keep returns the reason an object is
+// kept, objects kept without a reason aren't reported. keepCRD, if set, keeps
+// a crd for the reason it returns.
+func filteredCRDsCleanup(client clientset.Interface, pool dynamic.ClientPool, group string,
+	keep func(obj *unstructured.Unstructured) (bool, string), keepCRD func(crd apiextv1beta1.CustomResourceDefinition) string) error {
+	crds, err := getCRDsForGroup(client, group)
+	if err != nil {
+		return err
+	}
+	errs := []error{}
+	for _, crd := range crds {
+		resourceClient, resource, err := getCustomResourceClient(pool, crd)
+		if err != nil {
+			return err
+		}
+		items, err := getCustomResourceList(pool, crd, v1.ListOptions{})
+		if err != nil {
+			return err
+		}
+		remaining := 0
+		for _, item := range items {
+			if skipNamespace(item.GetNamespace()) {
+				remaining++
+				continue
+			}
+			if kept, reason := keep(&item); kept {
+				if reason != "" {
+					recordSkip(objectOf(item.GetAPIVersion(), item.GetKind(), &item), reason)
+				}
+				remaining++
+				continue
+			}
+			if len(item.GetFinalizers()) > 0 && stripFinalizers() {
+				item.SetFinalizers(nil)
+				_, err := resourceClient.Resource(resource, item.GetNamespace()).Update(&item)
+				if err = recordUpdate(objectOf(item.GetAPIVersion(), item.GetKind(), &item), err); err != nil {
+					errs = append(errs, err)
+					continue
+				}
+			}
+			logrus.Infof("deleting %s [%s]..", crd.Name, namespacedName(item.GetNamespace(), item.GetName()))
+			err := resourceClient.Resource(resource, item.GetNamespace()).Delete(item.GetName(), getDeleteOptions())
+			if errors.IsNotFound(err) {
+				continue
+			}
+			if err = recordDelete(objectOf(item.GetAPIVersion(), item.GetKind(), &item), err); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		obj := objectOf("apiextensions.k8s.io/v1beta1", "CustomResourceDefinition", &crd)
+		reason := ""
+		if keepCRD != nil {
+			reason = keepCRD(crd)
+		}
+		switch {
+		case reason != "":
+			recordSkip(obj, reason)
+		case remaining > 0:
+			logrus.Warnf("keeping custom resource definition [%s], %d custom resources remain", crd.Name, remaining)
+			recordSkip(obj, fmt.Sprintf("%d custom resources remain", remaining))
+		case keepCRDs:
+			recordSkip(obj, "crds are kept")
+		case !targetsClusterScope():
+			recordSkip(obj, "not a target namespace")
+		default:
+			logrus.Infof("deleting custom resource definition [%s]..", crd.Name)
+			err := client.ApiextensionsV1beta1().CustomResourceDefinitions().Delete(crd.Name, getDeleteOptions())
+			if err = recordDelete(obj, err); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return cleanupErrors(errs)
+	}
+	return nil
+}
+
+// crdsCleanup deletes all custom resource definitions of group along with
+// their custom resources.
+func crdsCleanup(client clientset.Interface, pool dynamic.ClientPool, group string) error {
+	crds, err := getCRDsForGroup(client, group)
+	if err != nil {
+		return err
+	}
+	for _, crd := range crds {
+		if err := customResourcesCleanup(pool, crd, v1.ListOptions{}); err != nil {
+			return err
+		}
+		if keepCRDs {
+			if err := waitCustomResourcesGone(pool, crd); err != nil {
+				return err
+			}
+			recordSkip(objectOf("apiextensions.k8s.io/v1beta1", "CustomResourceDefinition", &crd), "crds are kept")
+			continue
+		}
+		if !targetsClusterScope() {
+			recordSkip(objectOf("apiextensions.k8s.io/v1beta1", "CustomResourceDefinition", &crd), "not a target namespace")
+			continue
+		}
+		logrus.Infof("deleting custom resource definition [%s]..", crd.Name)
+		err := client.ApiextensionsV1beta1().CustomResourceDefinitions().Delete(crd.Name, getDeleteOptions())
+		if err = recordDelete(objectOf("apiextensions.k8s.io/v1beta1", "CustomResourceDefinition", &crd), err); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func namespacedName(namespace, name string) string {
+	if namespace == "" {
+		return name
+	}
+	return namespace + "/" + name
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh/terminal"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+// tokenRefreshMargin is how long before they expire tokens are refreshed, so
+// requests of long runs never go out with a token about to expire.
+const tokenRefreshMargin = time.Minute
+
+// execCredentialVersions are the client.authentication.k8s.io versions of
+// exec plugins client-go doesn't speak, aws eks get-token and the oidc login
+// plugins use v1beta1 and v1. v1alpha1 plugins are left to client-go.
+var execCredentialVersions = map[string]bool{
+	"client.authentication.k8s.io/v1beta1": true,
+	"client.authentication.k8s.io/v1":      true,
+}
+
+// getClientConfig loads kubeconfig the way kubectl does: the kubeconfig
+// files listed in KUBECONFIG are merged, ~/.kube/config is used when it is
+// not set and the in-cluster config when there is no kubeconfig at all.
+func getClientConfig(kubeconfig, context string) clientcmd.ClientConfig {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	// KUBECONFIG may hold a list, which the loading rules merge themselves
+	if kubeconfig != os.Getenv("KUBECONFIG") {
+		rules.ExplicitPath = kubeconfig
+	}
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{CurrentContext: context})
+}
+
+// loadRestConfig returns the rest config of context in kubeconfig with the
+// credentials of its user set up to refresh, see withCredentials.
+func loadRestConfig(kubeconfig, context string) (*rest.Config, error) {
+	config, err := getClientConfig(kubeconfig, context).ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	if err := withCredentials(config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// withCredentials replaces the exec plugins client-go doesn't speak with an
+// execAuthenticator. The oidc auth provider isn't registered by client-go,
+// its id token is used as is and not refreshed, an exec plugin like
+// kubelogin refreshes it.
+func withCredentials(config *rest.Config) error {
+	if plugin := config.ExecProvider; plugin != nil && plugin.APIVersion != "client.authentication.k8s.io/v1alpha1" {
+		if !execCredentialVersions[plugin.APIVersion] {
+			return fmt.Errorf("exec plugin [%s] uses unsupported api version [%s]", plugin.Command, plugin.APIVersion)
+		}
+		withTokenSource(config, &execAuthenticator{config: plugin})
+		config.ExecProvider = nil
+	}
+	if config.AuthProvider != nil && config.AuthProvider.Name == "oidc" {
+		token := config.AuthProvider.Config["id-token"]
+		if token == "" {
+			return fmt.Errorf("oidc auth provider has no id token, log in again or use an exec plugin")
+		}
+		logrus.Warnf("the oidc id token of the kubeconfig is not refreshed, log in again when it expires or use an exec plugin")
+		config.BearerToken = token
+		config.AuthProvider = nil
+		config.AuthConfigPersister = nil
+	}
+	return nil
+}
+
+// tokenSource hands out bearer tokens, refresh replaces stale, a token the
+// api server refused, unless it was replaced already.
+type tokenSource interface {
+	token() (string, error)
+	refresh(stale string) (string, error)
+}
+
+// bearerRoundTripper authenticates requests with the tokens of source, a
+// request refused with a token that expired early is retried once with a
+// fresh one.
+type bearerRoundTripper struct {
+	source    tokenSource
+	transport http.RoundTripper
+}
+
+func (t *bearerRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("Authorization") != "" {
+		return t.transport.RoundTrip(req)
+	}
+	token, err := t.source.token()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.transport.RoundTrip(withBearer(req, token))
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	if req.Body != nil && req.GetBody == nil {
+		return resp, nil
+	}
+	fresh, err := t.source.refresh(token)
+	if err != nil {
+		logrus.Warnf("failed to refresh credentials: %v", err)
+		return resp, nil
+	}
+	retry := withBearer(req, fresh)
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return resp, nil
+		}
+	}
+	resp.Body.Close()
+	return t.transport.RoundTrip(retry)
+}
+
+// withBearer copies req with token set, a round tripper must not modify the
+// request it is given.
+func withBearer(req *http.Request, token string) *http.Request {
+	authenticated := new(http.Request)
+	*authenticated = *req
+	authenticated.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		authenticated.Header[k] = append([]string(nil), v...)
+	}
+	authenticated.Header.Set("Authorization", "Bearer "+token)
+	return authenticated
+}
+
+// withTokenSource authenticates every request of config with source.
+func withTokenSource(config *rest.Config, source tokenSource) {
+	wrap := config.WrapTransport
+	config.WrapTransport = func(rt http.RoundTripper) http.RoundTripper {
+		if wrap != nil {
+			rt = wrap(rt)
+		}
+		return &bearerRoundTripper{source: source, transport: rt}
+	}
+}
+
+// execCredential is the ExecCredential of every client.authentication.k8s.io
+// version, they only differ in what the plugin may leave out.
+type execCredential struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Spec       struct {
+		Interactive bool `json:"interactive"`
+	} `json:"spec"`
+	Status *struct {
+		ExpirationTimestamp   *v1.Time `json:"expirationTimestamp,omitempty"`
+		Token                 string   `json:"token,omitempty"`
+		ClientCertificateData string   `json:"clientCertificateData,omitempty"`
+	} `json:"status,omitempty"`
+}
+
+// execAuthenticator gets tokens from the exec plugin of a kubeconfig user and
+// runs it again when they expire, client-go only speaks v1alpha1 to plugins.
+type execAuthenticator struct {
+	sync.Mutex
+	config *clientcmdapi.ExecConfig
+	cached string
+	expiry time.Time
+}
+
+func (a *execAuthenticator) token() (string, error) {
+	a.Lock()
+	defer a.Unlock()
+	if a.cached != "" && (a.expiry.IsZero() || time.Now().Add(tokenRefreshMargin).Before(a.expiry)) {
+		return a.cached, nil
+	}
+	return a.run()
+}
+
+func (a *execAuthenticator) refresh(stale string) (string, error) {
+	a.Lock()
+	defer a.Unlock()
+	if a.cached != stale {
+		return a.cached, nil
+	}
+	return a.run()
+}
+
+// run runs the plugin and caches the token it returns.
+func (a *execAuthenticator) run() (string, error) {
+	input := execCredential{APIVersion: a.config.APIVersion, Kind: "ExecCredential"}
+	input.Spec.Interactive = terminal.IsTerminal(int(os.Stdin.Fd()))
+	info, err := json.Marshal(input)
+	if err != nil {
+		return "", err
+	}
+	cmd := exec.Command(a.config.Command, a.config.Args...)
+	cmd.Env = append(os.Environ(), "KUBERNETES_EXEC_INFO="+string(info))
+	for _, env := range a.config.Env {
+		cmd.Env = append(cmd.Env, env.Name+"="+env.Value)
+	}
+	stdout := &bytes.Buffer{}
+	cmd.Stdout = stdout
+	cmd.Stderr = os.Stderr
+	if input.Spec.Interactive {
+		cmd.Stdin = os.Stdin
+	}
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("exec plugin [%s] failed: %v", a.config.Command, err)
+	}
+	output := execCredential{}
+	if err := json.Unmarshal(stdout.Bytes(), &output); err != nil {
+		return "", fmt.Errorf("exec plugin [%s] returned an invalid credential: %v", a.config.Command, err)
+	}
+	if output.APIVersion != a.config.APIVersion {
+		return "", fmt.Errorf("exec plugin [%s] returned api version [%s], [%s] is configured", a.config.Command, output.APIVersion, a.config.APIVersion)
+	}
+	switch {
+	case output.Status == nil:
+		return "", fmt.Errorf("exec plugin [%s] returned no status", a.config.Command)
+	case output.Status.Token == "" && output.Status.ClientCertificateData != "":
+		return "", fmt.Errorf("exec plugin [%s] returned a client certificate, only tokens are supported", a.config.Command)
+	case output.Status.Token == "":
+		return "", fmt.Errorf("exec plugin [%s] returned no token", a.config.Command)
+	}
+	a.cached = output.Status.Token
+	a.expiry = time.Time{}
+	if output.Status.ExpirationTimestamp != nil {
+		a.expiry = output.Status.ExpirationTimestamp.Time
+	}
+	return a.cached, nil
+}
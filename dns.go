@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// dnsProvider removes the dns records of a hostname, see --dns-provider.
+type dnsProvider interface {
+	// deleteRecords deletes the records of hostname and returns them as
+	// "<type> <name>".
+	deleteRecords(hostname string) ([]string, error)
+}
+
+// dnsProviders build the providers of --dns-provider by name, they fail when
+// their credentials are missing so the cleanup does not start without them.
+var dnsProviders = map[string]func(ctx *cli.Context) (dnsProvider, error){
+	"route53":    newRoute53Provider,
+	"cloudflare": newCloudflareProvider,
+	"webhook":    newWebhookProvider,
+}
+
+// dnsRecordTypes are the record types pointing a hostname at a load balancer.
+var dnsRecordTypes = map[string]bool{"A": true, "AAAA": true, "CNAME": true}
+
+var dnsClient = &http.Client{Timeout: 30 * time.Second}
+
+func getDNSProvider(ctx *cli.Context) (string, dnsProvider, error) {
+	name := ctx.String("dns-provider")
+	if name == "" {
+		return "", nil, nil
+	}
+	newProvider, ok := dnsProviders[name]
+	if !ok {
+		names := []string{}
+		for name := range dnsProviders {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return "", nil, fmt.Errorf("invalid dns provider [%s], must be one of %s", name, strings.Join(names, "|"))
+	}
+	provider, err := newProvider(ctx)
+	return name, provider, err
+}
+
+// dnsCleanup removes the dns records of hostname with provider once the load
+// balancer in front of rancher is gone.
+func dnsCleanup(name string, provider dnsProvider, hostname string) error {
+	if hostname == "" {
+		logrus.Warnf("rancher hostname is unknown, set --dns-hostname to remove its dns records")
+		return nil
+	}
+	logrus.Infof("deleting dns records of [%s] from %s..", hostname, name)
+	records, err := provider.deleteRecords(hostname)
+	for _, record := range records {
+		logrus.Infof("deleted dns record [%s]", record)
+		recordDelete(namedObject(name, "DNSRecord", "", record), nil)
+	}
+	if err != nil {
+		return recordDelete(namedObject(name, "DNSRecord", "", hostname), err)
+	}
+	if len(records) == 0 {
+		recordSkip(namedObject(name, "DNSRecord", "", hostname), "no records found")
+	}
+	return nil
+}
+
+// rancherHostname returns the host of serverURL, or an empty string.
+func rancherHostname(serverURL string) string {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+// route53Provider talks to the route53 api directly, requests are signed
+// with the credentials of the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN environment variables.
+type route53Provider struct {
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+const route53Endpoint = "https://route53.amazonaws.com/2013-04-01"
+
+func newRoute53Provider(ctx *cli.Context) (dnsProvider, error) {
+	p := &route53Provider{
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if p.accessKey == "" || p.secretKey == "" {
+		return nil, fmt.Errorf("the route53 dns provider needs AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	return p, nil
+}
+
+func (p *route53Provider) deleteRecords(hostname string) ([]string, error) {
+	fqdn := strings.TrimSuffix(hostname, ".") + "."
+	zoneID, err := p.findZone(fqdn)
+	if err != nil {
+		return nil, err
+	}
+	if zoneID == "" {
+		return nil, fmt.Errorf("no route53 hosted zone found for [%s]", hostname)
+	}
+	sets := struct {
+		Sets []struct {
+			Name     string `xml:"Name"`
+			Type     string `xml:"Type"`
+			InnerXML string `xml:",innerxml"`
+		} `xml:"ResourceRecordSets>ResourceRecordSet"`
+	}{}
+	query := url.Values{"name": {fqdn}, "maxitems": {"100"}}
+	if err := p.do(http.MethodGet, "/hostedzone/"+zoneID+"/rrset?"+query.Encode(), nil, &sets); err != nil {
+		return nil, err
+	}
+	changes := &bytes.Buffer{}
+	records := []string{}
+	for _, set := range sets.Sets {
+		if set.Name != fqdn || !dnsRecordTypes[set.Type] {
+			continue
+		}
+		fmt.Fprintf(changes, "<Change><Action>DELETE</Action><ResourceRecordSet>%s</ResourceRecordSet></Change>", set.InnerXML)
+		records = append(records, set.Type+" "+hostname)
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+	body := `<?xml version="1.0" encoding="UTF-8"?>` +
+		`<ChangeResourceRecordSetsRequest xmlns="https://route53.amazonaws.com/doc/2013-04-01/">` +
+		`<ChangeBatch><Comment>removed by rmrancher</Comment><Changes>` + changes.String() + `</Changes></ChangeBatch>` +
+		`</ChangeResourceRecordSetsRequest>`
+	if err := p.do(http.MethodPost, "/hostedzone/"+zoneID+"/rrset", []byte(body), nil); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// findZone returns the id of the hosted zone with the longest name fqdn is
+// in.
+func (p *route53Provider) findZone(fqdn string) (string, error) {
+	zoneID, zoneName, marker := "", "", ""
+	for {
+		zones := struct {
+			Zones []struct {
+				ID   string `xml:"Id"`
+				Name string `xml:"Name"`
+			} `xml:"HostedZones>HostedZone"`
+			IsTruncated bool   `xml:"IsTruncated"`
+			NextMarker  string `xml:"NextMarker"`
+		}{}
+		path := "/hostedzone"
+		if marker != "" {
+			path += "?" + url.Values{"marker": {marker}}.Encode()
+		}
+		if err := p.do(http.MethodGet, path, nil, &zones); err != nil {
+			return "", err
+		}
+		for _, zone := range zones.Zones {
+			if (fqdn == zone.Name || strings.HasSuffix(fqdn, "."+zone.Name)) && len(zone.Name) > len(zoneName) {
+				zoneID, zoneName = strings.TrimPrefix(zone.ID, "/hostedzone/"), zone.Name
+			}
+		}
+		if !zones.IsTruncated {
+			return zoneID, nil
+		}
+		marker = zones.NextMarker
+	}
+}
+
+func (p *route53Provider) do(method, path string, body []byte, out interface{}) error {
+	req, err := http.NewRequest(method, route53Endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/xml")
+	}
+	p.sign(req, body, time.Now().UTC())
+	resp, err := dnsClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("route53 %s %s returned %s: %s", method, req.URL.Path, resp.Status, strings.TrimSpace(string(data)))
+	}
+	if out == nil {
+		return nil
+	}
+	return xml.Unmarshal(data, out)
+}
+
+// sign signs req with aws signature version 4, route53 is global and signed
+// for us-east-1.
+func (p *route53Provider) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if p.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", p.sessionToken)
+	}
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(req.Header.Get(name))
+	}
+	names := []string{}
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	canonicalHeaders := &bytes.Buffer{}
+	for _, name := range names {
+		fmt.Fprintf(canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+	// aws wants spaces escaped as %20 and the parameters sorted, which Encode
+	// does
+	canonicalQuery := strings.Replace(req.URL.Query().Encode(), "+", "%20", -1)
+	canonicalRequest := strings.Join([]string{req.Method, req.URL.EscapedPath(), canonicalQuery, canonicalHeaders.String(), signedHeaders, payloadHash}, "\n")
+	scope := day + "/us-east-1/route53/aws4_request"
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+	key := []byte("AWS4" + p.secretKey)
+	for _, part := range []string{day, "us-east-1", "route53", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", p.accessKey, scope, signedHeaders, signature))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// cloudflareProvider uses the api token of the CLOUDFLARE_API_TOKEN
+// environment variable, it needs the zone read and dns edit permissions.
+type cloudflareProvider struct {
+	token string
+}
+
+const cloudflareEndpoint = "https://api.cloudflare.com/client/v4"
+
+func newCloudflareProvider(ctx *cli.Context) (dnsProvider, error) {
+	token := os.Getenv("CLOUDFLARE_API_TOKEN")
+	if token == "" {
+		return nil, fmt.Errorf("the cloudflare dns provider needs CLOUDFLARE_API_TOKEN")
+	}
+	return &cloudflareProvider{token: token}, nil
+}
+
+func (p *cloudflareProvider) deleteRecords(hostname string) ([]string, error) {
+	hostname = strings.TrimSuffix(hostname, ".")
+	zoneID := ""
+	// the zone is the longest suffix of the hostname cloudflare knows
+	labels := strings.Split(hostname, ".")
+	for i := 0; i < len(labels)-1 && zoneID == ""; i++ {
+		zones := []struct {
+			ID string `json:"id"`
+		}{}
+		if err := p.do(http.MethodGet, "/zones?"+url.Values{"name": {strings.Join(labels[i:], ".")}}.Encode(), &zones); err != nil {
+			return nil, err
+		}
+		if len(zones) > 0 {
+			zoneID = zones[0].ID
+		}
+	}
+	if zoneID == "" {
+		return nil, fmt.Errorf("no cloudflare zone found for [%s]", hostname)
+	}
+	dnsRecords := []struct {
+		ID   string `json:"id"`
+		Type string `json:"type"`
+		Name string `json:"name"`
+	}{}
+	if err := p.do(http.MethodGet, "/zones/"+zoneID+"/dns_records?"+url.Values{"name": {hostname}}.Encode(), &dnsRecords); err != nil {
+		return nil, err
+	}
+	records := []string{}
+	for _, record := range dnsRecords {
+		if !dnsRecordTypes[record.Type] {
+			continue
+		}
+		if err := p.do(http.MethodDelete, "/zones/"+zoneID+"/dns_records/"+record.ID, nil); err != nil {
+			return records, err
+		}
+		records = append(records, record.Type+" "+record.Name)
+	}
+	return records, nil
+}
+
+func (p *cloudflareProvider) do(method, path string, out interface{}) error {
+	req, err := http.NewRequest(method, cloudflareEndpoint+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.token)
+	resp, err := dnsClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	envelope := struct {
+		Success bool            `json:"success"`
+		Errors  json.RawMessage `json:"errors"`
+		Result  json.RawMessage `json:"result"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+		return fmt.Errorf("cloudflare %s %s returned %s", method, req.URL.Path, resp.Status)
+	}
+	if !envelope.Success {
+		return fmt.Errorf("cloudflare %s %s failed: %s", method, req.URL.Path, envelope.Errors)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(envelope.Result, out)
+}
+
+// webhookProvider posts {"action": "delete", "hostname": <hostname>} to
+// --dns-webhook-url, with the DNS_WEBHOOK_TOKEN environment variable as
+// bearer token when set. Any 2xx response means the records are gone.
+type webhookProvider struct {
+	url   string
+	token string
+}
+
+func newWebhookProvider(ctx *cli.Context) (dnsProvider, error) {
+	u := ctx.String("dns-webhook-url")
+	if u == "" {
+		return nil, fmt.Errorf("the webhook dns provider needs --dns-webhook-url")
+	}
+	return &webhookProvider{url: u, token: os.Getenv("DNS_WEBHOOK_TOKEN")}, nil
+}
+
+func (p *webhookProvider) deleteRecords(hostname string) ([]string, error) {
+	body, err := json.Marshal(map[string]string{"action": "delete", "hostname": hostname})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.token)
+	}
+	resp, err := dnsClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		data, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("dns webhook returned %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	return []string{"* " + hostname}, nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const defaultRancherDataDir = "/var/lib/rancher"
+
+func doRemoveDockerRancher(ctx *cli.Context) error {
+	containers := ctx.StringSlice("container")
+	if len(containers) == 0 {
+		found, err := getRancherContainers(ctx.String("image"))
+		if err != nil {
+			return err
+		}
+		containers = found
+	}
+	if len(containers) == 0 {
+		logrus.Infof("no rancher containers found")
+	}
+	for _, container := range containers {
+		volumes, err := getContainerVolumes(container)
+		if err != nil {
+			return err
+		}
+		logrus.Infof("removing rancher container [%s]..", container)
+		if _, err := runDocker("rm", "-f", "-v", container); err != nil {
+			return err
+		}
+		for _, volume := range volumes {
+			logrus.Infof("removing volume [%s]..", volume)
+			if _, err := runDocker("volume", "rm", volume); err != nil {
+				return err
+			}
+		}
+	}
+
+	dataDir := ctx.String("data-dir")
+	if _, err := os.Stat(dataDir); os.IsNotExist(err) {
+		return nil
+	}
+	ok := ctx.Bool("yes")
+	if !ok {
+		var err error
+		ok, err = confirm(fmt.Sprintf("remove rancher data directory [%s]?", dataDir))
+		if err != nil {
+			return err
+		}
+	}
+	if !ok {
+		logrus.Infof("keeping rancher data directory [%s]", dataDir)
+		return nil
+	}
+	logrus.Infof("removing rancher data directory [%s]..", dataDir)
+	return os.RemoveAll(dataDir)
+}
+
+func getRancherContainers(image string) ([]string, error) {
+	out, err := runDocker("ps", "-a", "--format", "{{.ID}} {{.Image}}")
+	if err != nil {
+		return nil, err
+	}
+	containers := []string{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		if fields[1] == image || strings.HasPrefix(fields[1], image+":") {
+			containers = append(containers, fields[0])
+		}
+	}
+	return containers, nil
+}
+
+// getContainerVolumes returns the named volumes mounted into container, anonymous
+// volumes are removed along with the container.
+func getContainerVolumes(container string) ([]string, error) {
+	out, err := runDocker("inspect", "-f", `{{range .Mounts}}{{if eq .Type "volume"}}{{.Name}} {{end}}{{end}}`, container)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(out), nil
+}
+
+func runDocker(args ...string) (string, error) {
+	out, err := exec.Command("docker", args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("docker %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
+
+func confirm(prompt string) (bool, error) {
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", prompt)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false, err
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes", nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// clusterDump holds the objects of an exported cluster the plan needs, see
+// plan --from-dump.
+type clusterDump struct {
+	clusters            []v3.Cluster
+	projects            []v3.Project
+	users               []v3.User
+	globalRoleBindings  []v3.GlobalRoleBinding
+	namespaces          []corev1.Namespace
+	clusterRoleBindings []rbacv1.ClusterRoleBinding
+	roleBindings        []rbacv1.RoleBinding
+}
+
+// doPlanFromDump prints the plan of the cluster exported to dir.
+func doPlanFromDump(ctx *cli.Context, dir string) error {
+	dump, err := readClusterDump(dir)
+	if err != nil {
+		return err
+	}
+	admins := []string{}
+	if !ctx.Bool("include-admin-users") {
+		admins = adminUsersOf(dump.globalRoleBindings)
+	}
+	keptClusters, keptUsers := getPlanKept(ctx, admins)
+	printPlan(os.Stdout, dump.clusters, dump.projects, dump.users, keptClusters, keptUsers,
+		projectNamespacesOf(dump.namespaces), userBindingsOf(dump.clusterRoleBindings, dump.roleBindings))
+	return nil
+}
+
+// readClusterDump reads every .yaml, .yml and .json file under dir, files may
+// hold several documents and lists.
+func readClusterDump(dir string) (*clusterDump, error) {
+	dump := &clusterDump{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".yaml", ".yml", ".json":
+		default:
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		decoder := yaml.NewYAMLOrJSONDecoder(f, 4096)
+		for {
+			obj := map[string]interface{}{}
+			if err := decoder.Decode(&obj); err == io.EOF {
+				return nil
+			} else if err != nil {
+				return fmt.Errorf("reading dump file [%s]: %v", path, err)
+			}
+			if err := dump.add(obj); err != nil {
+				return fmt.Errorf("reading dump file [%s]: %v", path, err)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	logrus.Infof("read %d clusters, %d projects and %d users from dump [%s]", len(dump.clusters), len(dump.projects), len(dump.users), dir)
+	return dump, nil
+}
+
+func (d *clusterDump) add(obj map[string]interface{}) error {
+	kind, _ := obj["kind"].(string)
+	if items, ok := obj["items"].([]interface{}); ok && strings.HasSuffix(kind, "List") {
+		for _, item := range items {
+			if item, ok := item.(map[string]interface{}); ok {
+				if err := d.add(item); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	apiVersion, _ := obj["apiVersion"].(string)
+	gv, err := schema.ParseGroupVersion(apiVersion)
+	if err != nil {
+		return err
+	}
+	convert := runtime.DefaultUnstructuredConverter.FromUnstructured
+	switch {
+	case gv.Group == managementGroup && kind == "Cluster":
+		cluster := v3.Cluster{}
+		err = convert(obj, &cluster)
+		d.clusters = append(d.clusters, cluster)
+	case gv.Group == managementGroup && kind == "Project":
+		project := v3.Project{}
+		err = convert(obj, &project)
+		d.projects = append(d.projects, project)
+	case gv.Group == managementGroup && kind == "User":
+		user := v3.User{}
+		err = convert(obj, &user)
+		d.users = append(d.users, user)
+	case gv.Group == managementGroup && kind == "GlobalRoleBinding":
+		grb := v3.GlobalRoleBinding{}
+		err = convert(obj, &grb)
+		d.globalRoleBindings = append(d.globalRoleBindings, grb)
+	case gv.Group == "" && kind == "Namespace":
+		ns := corev1.Namespace{}
+		err = convert(obj, &ns)
+		d.namespaces = append(d.namespaces, ns)
+	case gv.Group == rbacv1.GroupName && kind == "ClusterRoleBinding":
+		crb := rbacv1.ClusterRoleBinding{}
+		err = convert(obj, &crb)
+		d.clusterRoleBindings = append(d.clusterRoleBindings, crb)
+	case gv.Group == rbacv1.GroupName && kind == "RoleBinding":
+		rb := rbacv1.RoleBinding{}
+		err = convert(obj, &rb)
+		d.roleBindings = append(d.roleBindings, rb)
+	}
+	return err
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"github.com/rancher/rmrancher/cleanup"
+	"github.com/sirupsen/logrus"
+)
+
+// objectError is the failure to delete or update a single object,
+// cleanupErrors aggregates the failures of a cleanup step. Both live in the
+// cleanup package so code embedding the cleanup can inspect them.
+type (
+	objectError   = cleanup.ObjectError
+	cleanupErrors = cleanup.Errors
+)
+
+// isTimeout reports whether err, or any failure it aggregates, is an api
+// request that timed out, see --object-timeout and --phase-timeout.
+func isTimeout(err error) bool {
+	return cleanup.IsTimeout(err)
+}
+
+// logFailures prints a summary of the object failures in err, if any.
+func logFailures(err error) {
+	var objects []*objectError
+	switch err := err.(type) {
+	case *objectError:
+		objects = []*objectError{err}
+	case cleanupErrors:
+		objects = err.Objects()
+	}
+	retryable := 0
+	for _, object := range objects {
+		mark := ""
+		if object.Retryable() {
+			mark = " (retryable)"
+			retryable++
+		}
+		logrus.Errorf("failed to %s%s", object.Error(), mark)
+	}
+	if retryable > 0 {
+		logrus.Infof("%d of %d failed objects may succeed when running the cleanup again", retryable, len(objects))
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/rancher/norman/types/slice"
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// rancherNamespacePrefixes are the prefixes of namespaces created by rancher
+// for clusters, projects and users.
+var rancherNamespacePrefixes = []string{"cattle-", "c-", "p-", "user-"}
+
+// printFootprintDiff prints what was removed between the before and after
+// footprints and what is left.
+func printFootprintDiff(before, after sets.String) {
+	removed := before.Difference(after)
+	fmt.Printf("removed %d rancher objects:\n", removed.Len())
+	for _, obj := range removed.List() {
+		fmt.Printf("- %s\n", obj)
+	}
+	if after.Len() == 0 {
+		fmt.Println("no rancher objects remain")
+		return
+	}
+	fmt.Printf("%d rancher objects remain:\n", after.Len())
+	for _, obj := range after.List() {
+		fmt.Printf("  %s\n", obj)
+	}
+	if added := after.Difference(before); added.Len() > 0 {
+		logrus.Warnf("%d rancher objects were created during the cleanup: %s", added.Len(), strings.Join(added.List(), ", "))
+	}
+}
+
+func isStaticClusterRole(name string) bool {
+	for _, clusterRole := range staticClusterRoles {
+		if name == clusterRole {
+			return true
+		}
+	}
+	return false
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// removableFootprint returns the footprint of the objects of inv the current
+// run removes. Kept clusters and users, protected namespaces and what the run
+// leaves in place on purpose, like the management.cattle.io crds, are left
+// out so it is empty once the cleanup is done.
+func (inv *inventory) removableFootprint() sets.String {
+	keeper := &provisioningKeeper{clusters: sets.NewString()}
+	removedNamespaces := sets.NewString(cattleNamespace)
+	for _, item := range inv.Items {
+		gv, _ := schema.ParseGroupVersion(item.Object.GetAPIVersion())
+		switch {
+		case gv.Group == provisioningGroups[0] && item.Resource == "clusters":
+			keeper.addCluster(item.Object)
+		case gv.Group == managementGroup && item.Resource == "clusters" && !keepClusters[item.Object.GetName()]:
+			removedNamespaces.Insert(item.Object.GetName())
+		case gv.Group == managementGroup && item.Resource == "projects" && !keepClusters[item.Object.GetNamespace()]:
+			removedNamespaces.Insert(item.Object.GetName())
+		}
+	}
+	removedGroups := sets.NewString(provisioningGroups...)
+	for _, c := range removedComponents {
+		removedGroups.Insert(c.crdGroups...)
+		removedNamespaces.Insert(c.namespaces...)
+	}
+	footprint := sets.NewString()
+	keptCRDs := sets.NewString()
+	crds := []*unstructured.Unstructured{}
+	for _, item := range inv.Items {
+		obj := item.Object
+		gv, _ := schema.ParseGroupVersion(obj.GetAPIVersion())
+		removed := false
+		switch {
+		case obj.GetKind() == "CustomResourceDefinition":
+			crds = append(crds, obj)
+			continue
+		case obj.GetKind() == "Namespace":
+			removed = removesNamespace(obj.GetName(), removedNamespaces)
+		case gv.Group == rbacGroupVersion.Group:
+			removed = targetsClusterScope() && keptReason(obj) == "" && (deleteSuspicious || suspiciousReason(obj) == "")
+		case gv.Group == webhooksGroupVersion.Group:
+			removed = targetsClusterScope() && (deadWebhooks == DeadWebhooksDelete || removedByComponent(obj.GetName()))
+		case gv.Group == managementGroup:
+			removed = removesManagementResource(item)
+		case gv.Group == projectGroup:
+			removed = !skipNamespace(obj.GetNamespace()) && slice.ContainsString(projectResources, item.Resource)
+		case removedGroups.Has(gv.Group):
+			kept, _ := keeper.keep(obj)
+			removed = !kept && !skipNamespace(obj.GetNamespace())
+		}
+		if removed {
+			footprint.Insert(footprintEntry(obj))
+		} else if isCattleGroup(gv.Group) {
+			keptCRDs.Insert(item.Resource + "." + gv.Group)
+		}
+	}
+	if keepCRDs || !targetsClusterScope() {
+		return footprint
+	}
+	for _, crd := range crds {
+		group, _, _ := unstructured.NestedString(crd.Object, "spec", "group")
+		if removedGroups.Has(group) && !keptCRDs.Has(crd.GetName()) {
+			footprint.Insert(footprintEntry(crd))
+		}
+	}
+	return footprint
+}
+
+// removesNamespace reports whether the run deletes the namespace name, see
+// deleteNamespace.
+func removesNamespace(name string, removedNamespaces sets.String) bool {
+	if !removedNamespaces.Has(name) && !rancherCreatedNamespaces[name] && !pipelineNamespacePattern.MatchString(name) {
+		return false
+	}
+	return namespaceSkipReason(name) == ""
+}
+
+// removesManagementResource reports whether the run deletes the
+// management.cattle.io object of item, the group itself stays in place.
+func removesManagementResource(item inventoryObject) bool {
+	obj := item.Object
+	if skipNamespace(obj.GetNamespace()) {
+		return false
+	}
+	switch item.Resource {
+	case "clusters":
+		return targetsClusterScope() && !keepClusters[obj.GetName()]
+	case "projects":
+		return !keepClusters[obj.GetNamespace()]
+	case "users":
+		return targetsClusterScope() && !keepUsers[obj.GetName()]
+	}
+	if slice.ContainsString(authTokenResources, item.Resource) {
+		userID, _, _ := unstructured.NestedString(obj.Object, "userId")
+		return (item.Namespaced || targetsClusterScope()) && !keepUsers[userID]
+	}
+	return slice.ContainsString(managementResources, item.Resource) || slice.ContainsString(authGroupResources, item.Resource)
+}
+
+// removedByComponent reports whether the cluster scoped object name belongs
+// to one of the removed components.
+func removedByComponent(name string) bool {
+	for _, c := range removedComponents {
+		if c.matches(name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	admissionv1beta1 "k8s.io/api/admissionregistration/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+)
+
+// guardName is the validating webhook configuration of the recreation guard,
+// guardLabel marks the namespaces it covers and guardDomain qualifies the
+// names of its webhooks.
+const (
+	guardName   = "rmrancher-deny-recreation"
+	guardLabel  = "rmrancher.io/deny-recreation"
+	guardDomain = "deny-recreation.rmrancher.io"
+)
+
+// guardURL is where the webhooks of the guard send their reviews. Nothing
+// listens there, the review fails and failurePolicy Fail denies the request,
+// so the guard needs no server of its own.
+const guardURL = "https://127.0.0.1:1/deny-recreation"
+
+// guardTimeout bounds the removal of the guard, which has to go through even
+// when the run was cancelled.
+const guardTimeout = 30 * time.Second
+
+// guardedResources are the namespaced resources rancher agents put back in
+// the namespaces being removed. They are listed one by one, namespace
+// selectors don't apply to cluster scoped resources a wildcard would match.
+var guardedResources = []admissionv1beta1.Rule{
+	{APIGroups: []string{""}, APIVersions: []string{"*"}, Resources: []string{"configmaps", "secrets", "serviceaccounts", "services", "pods"}},
+	{APIGroups: []string{"apps", "extensions"}, APIVersions: []string{"*"}, Resources: []string{"deployments", "daemonsets", "statefulsets"}},
+	{APIGroups: []string{"rbac.authorization.k8s.io"}, APIVersions: []string{"*"}, Resources: []string{"roles", "rolebindings"}},
+}
+
+// installRecreationGuard creates a validating webhook configuration denying
+// the creation of objects of the cattle api groups, and of the guarded
+// resources in the rancher namespaces being removed, so rancher agents still
+// around can't put them back, see --deny-recreation. The configuration is
+// owned by the rancher deployment namespace so the garbage collector removes
+// it along with the namespace should the run die before removing it, and a
+// guard left behind is replaced by the next run.
+func installRecreationGuard(client *kubernetes.Clientset) error {
+	if err := removeRecreationGuard(client); err != nil {
+		return err
+	}
+	groups := []string{}
+	for _, group := range servedGroups.List() {
+		if strings.HasSuffix(group, ".cattle.io") {
+			groups = append(groups, group)
+		}
+	}
+	candidates := sets.NewString(cattleNamespace)
+	for namespace := range rancherCreatedNamespaces {
+		candidates.Insert(namespace)
+	}
+	namespaces := []string{}
+	for _, namespace := range candidates.List() {
+		if skipNamespace(namespace) {
+			continue
+		}
+		guarded, err := labelGuardedNamespace(client, namespace)
+		if err != nil {
+			return err
+		}
+		if guarded {
+			namespaces = append(namespaces, namespace)
+		}
+	}
+
+	fail := admissionv1beta1.Fail
+	url := guardURL
+	webhook := func(name string, rules []admissionv1beta1.Rule, selector *v1.LabelSelector) admissionv1beta1.Webhook {
+		withOperations := []admissionv1beta1.RuleWithOperations{}
+		for _, rule := range rules {
+			withOperations = append(withOperations, admissionv1beta1.RuleWithOperations{
+				Operations: []admissionv1beta1.OperationType{admissionv1beta1.Create},
+				Rule:       rule,
+			})
+		}
+		return admissionv1beta1.Webhook{
+			Name:              name,
+			ClientConfig:      admissionv1beta1.WebhookClientConfig{URL: &url},
+			Rules:             withOperations,
+			FailurePolicy:     &fail,
+			NamespaceSelector: selector,
+		}
+	}
+	config := &admissionv1beta1.ValidatingWebhookConfiguration{
+		ObjectMeta: v1.ObjectMeta{Name: guardName},
+	}
+	if len(groups) > 0 {
+		rule := admissionv1beta1.Rule{APIGroups: groups, APIVersions: []string{"*"}, Resources: []string{"*"}}
+		config.Webhooks = append(config.Webhooks, webhook("cattle-groups."+guardDomain, []admissionv1beta1.Rule{rule}, nil))
+	}
+	if len(namespaces) > 0 {
+		selector := &v1.LabelSelector{MatchLabels: map[string]string{guardLabel: "true"}}
+		config.Webhooks = append(config.Webhooks, webhook("cattle-namespaces."+guardDomain, guardedResources, selector))
+	}
+	if len(config.Webhooks) == 0 {
+		return nil
+	}
+	if ns, err := client.CoreV1().Namespaces().Get(cattleNamespace, v1.GetOptions{}); err == nil {
+		config.OwnerReferences = []v1.OwnerReference{{APIVersion: "v1", Kind: "Namespace", Name: ns.Name, UID: ns.UID}}
+	} else if !errors.IsNotFound(err) {
+		return err
+	}
+	logrus.Infof("installing validating webhook configuration [%s]..", guardName)
+	_, err := client.AdmissionregistrationV1beta1().ValidatingWebhookConfigurations().Create(config)
+	return err
+}
+
+// removeRecreationGuard deletes the webhook configuration of the guard and
+// takes the guard label off the namespaces. Its requests are not bound to
+// the run context, the guard must not outlive a cancelled run.
+func removeRecreationGuard(client *kubernetes.Clientset) error {
+	ctx, cancel := context.WithTimeout(context.Background(), guardTimeout)
+	defer cancel()
+	err := client.AdmissionregistrationV1beta1().RESTClient().Delete().
+		Context(ctx).
+		Resource("validatingwebhookconfigurations").
+		Name(guardName).
+		Do().
+		Error()
+	if err == nil {
+		logrus.Infof("removed validating webhook configuration [%s]", guardName)
+	} else if !errors.IsNotFound(err) {
+		logrus.Errorf("failed to delete validating webhook configuration [%s], delete it manually: %v", guardName, err)
+		return err
+	}
+	nsList := &corev1.NamespaceList{}
+	err = client.CoreV1().RESTClient().Get().
+		Context(ctx).
+		Resource("namespaces").
+		VersionedParams(&v1.ListOptions{LabelSelector: guardLabel}, scheme.ParameterCodec).
+		Do().
+		Into(nsList)
+	if err != nil {
+		logrus.Errorf("failed to list the namespaces labeled [%s], remove the label manually: %v", guardLabel, err)
+		return err
+	}
+	for _, ns := range nsList.Items {
+		patch := []byte(`{"metadata":{"labels":{"` + guardLabel + `":null}}}`)
+		err := client.CoreV1().RESTClient().Patch(types.MergePatchType).
+			Context(ctx).
+			Resource("namespaces").
+			Name(ns.Name).
+			Body(patch).
+			Do().
+			Error()
+		if err != nil && !errors.IsNotFound(err) {
+			logrus.Errorf("failed to remove label [%s] from namespace [%s], remove it manually: %v", guardLabel, ns.Name, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// labelGuardedNamespace puts namespace under the guard, it reports whether
+// the namespace exists.
+func labelGuardedNamespace(client *kubernetes.Clientset, namespace string) (bool, error) {
+	ns, err := client.CoreV1().Namespaces().Get(namespace, v1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if ns.Labels == nil {
+		ns.Labels = map[string]string{}
+	}
+	ns.Labels[guardLabel] = "true"
+	_, err = client.CoreV1().Namespaces().Update(ns)
+	return err == nil, err
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// the ways rancher is installed, told apart by detectInstall.
+const (
+	// InstallHelm is the rancher chart, an HA install in cattleNamespace
+	InstallHelm = "helm"
+	// InstallManifest is a rancher deployment applied without helm
+	InstallManifest = "manifest"
+	// InstallSingleNode is a rancher docker container, the cluster is the
+	// one embedded in the container
+	InstallSingleNode = "single-node"
+	// InstallUnknown is a cluster without a rancher server, rancher is gone
+	// or this is a downstream cluster
+	InstallUnknown = "unknown"
+)
+
+// singleNodeName is the node of the cluster embedded in a single node
+// rancher container.
+const singleNodeName = "local-node"
+
+// tillerName is the deployment and service of tiller, tillerAccount the
+// service account and cluster role binding the rancher docs had it run as.
+const (
+	tillerName    = "tiller-deploy"
+	tillerAccount = "tiller"
+)
+
+// helmReleaseSelector selects the release secrets helm 3 keeps for the
+// rancher release.
+var helmReleaseSelector = "owner=helm,name=" + rancherRelease
+
+// tillerNamespace is where helm 2 installs tiller and where tiller keeps the
+// release configmaps.
+const tillerNamespace = v1.NamespaceSystem
+
+// tillerReleaseSelector selects the release configmaps tiller keeps for the
+// rancher release, tillerSelector those of every release.
+var (
+	tillerSelector        = "OWNER=TILLER"
+	tillerReleaseSelector = tillerSelector + ",NAME=" + rancherRelease
+)
+
+// deleteTiller removes tiller along with the rancher release configmaps when
+// rancher was its last release, see --delete-tiller.
+var deleteTiller bool
+
+// installType is the install detected at the start of the run.
+var installType = InstallUnknown
+
+// detectInstall tells how rancher was installed in the cluster of client.
+func detectInstall(client *kubernetes.Clientset) (string, error) {
+	deployment, err := client.AppsV1().Deployments(cattleNamespace).Get("rancher", v1.GetOptions{})
+	if err == nil {
+		if deployment.Labels["heritage"] == "Helm" || deployment.Labels["heritage"] == "Tiller" || deployment.Labels["app.kubernetes.io/managed-by"] == "Helm" ||
+			deployment.Annotations["meta.helm.sh/release-name"] == rancherRelease {
+			return InstallHelm, nil
+		}
+		releases, err := client.CoreV1().Secrets(cattleNamespace).List(v1.ListOptions{LabelSelector: helmReleaseSelector})
+		if err != nil {
+			return "", err
+		}
+		if len(releases.Items) > 0 {
+			return InstallHelm, nil
+		}
+		tillerReleases, err := client.CoreV1().ConfigMaps(tillerNamespace).List(v1.ListOptions{LabelSelector: tillerReleaseSelector})
+		if err != nil {
+			return "", err
+		}
+		if len(tillerReleases.Items) > 0 {
+			return InstallHelm, nil
+		}
+		return InstallManifest, nil
+	} else if !errors.IsNotFound(err) {
+		return "", err
+	}
+	if !servedGroups.Has(managementGroup) {
+		return InstallUnknown, nil
+	}
+	if _, err := client.CoreV1().Nodes().Get(singleNodeName, v1.GetOptions{}); err == nil {
+		return InstallSingleNode, nil
+	} else if !errors.IsNotFound(err) {
+		return "", err
+	}
+	return InstallUnknown, nil
+}
+
+// describeInstall is the install line of the plan.
+func describeInstall(install string) string {
+	switch install {
+	case InstallHelm:
+		return fmt.Sprintf("helm release %s in %s", rancherRelease, cattleNamespace)
+	case InstallManifest:
+		return fmt.Sprintf("rancher deployment in %s, not managed by helm", cattleNamespace)
+	case InstallSingleNode:
+		return "single node docker container, remove the container with `rmrancher docker` on its host"
+	}
+	return "no rancher server found"
+}
+
+// helmReleaseCleanup deletes the release secrets of the rancher chart so a
+// reinstall does not find the old release, they are not left to the
+// namespace when it is kept. The configmaps tiller keeps for a helm 2
+// release are outside the namespace and would be left behind by any install
+// as old as helm 2.
+func helmReleaseCleanup(client *kubernetes.Clientset) error {
+	errs := []error{}
+	if !skipNamespace(cattleNamespace) {
+		releases, err := client.CoreV1().Secrets(cattleNamespace).List(v1.ListOptions{LabelSelector: helmReleaseSelector})
+		if err != nil {
+			return err
+		}
+		for _, secret := range releases.Items {
+			logrus.Infof("deleting helm release secret [%s/%s]..", secret.Namespace, secret.Name)
+			err := client.CoreV1().Secrets(secret.Namespace).Delete(secret.Name, getDeleteOptions())
+			if errors.IsNotFound(err) {
+				continue
+			}
+			if err = recordDelete(objectOf("v1", "Secret", &secret), err); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if !skipNamespace(tillerNamespace) {
+		releases, err := client.CoreV1().ConfigMaps(tillerNamespace).List(v1.ListOptions{LabelSelector: tillerReleaseSelector})
+		if err != nil {
+			return err
+		}
+		for _, configMap := range releases.Items {
+			logrus.Infof("deleting tiller release configmap [%s/%s]..", configMap.Namespace, configMap.Name)
+			err := client.CoreV1().ConfigMaps(configMap.Namespace).Delete(configMap.Name, getDeleteOptions())
+			if errors.IsNotFound(err) {
+				continue
+			}
+			if err = recordDelete(objectOf("v1", "ConfigMap", &configMap), err); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		if deleteTiller && len(errs) == 0 {
+			if err := tillerCleanup(client); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return cleanupErrors(errs)
+	}
+	return nil
+}
+
+// tillerCleanup removes tiller and the service account the rancher install
+// docs had it run as, unless it still manages other releases.
+func tillerCleanup(client *kubernetes.Clientset) error {
+	releases, err := client.CoreV1().ConfigMaps(tillerNamespace).List(v1.ListOptions{LabelSelector: tillerSelector})
+	if err != nil {
+		return err
+	}
+	others := map[string]bool{}
+	for _, configMap := range releases.Items {
+		others[configMap.Labels["NAME"]] = true
+	}
+	if len(others) > 0 {
+		names := []string{}
+		for name := range others {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		logrus.Warnf("tiller still manages releases %s, leaving it in place", strings.Join(names, ", "))
+		recordSkip(namedObject("apps/v1", "Deployment", tillerNamespace, tillerName), "manages releases "+strings.Join(names, ", "))
+		return nil
+	}
+	logrus.Infof("removing tiller from [%s]..", tillerNamespace)
+	errs := []error{}
+	deletes := []struct {
+		obj    reportObject
+		delete func() error
+	}{
+		{namedObject("apps/v1", "Deployment", tillerNamespace, tillerName), func() error {
+			return client.AppsV1().Deployments(tillerNamespace).Delete(tillerName, getDeleteOptions())
+		}},
+		{namedObject("v1", "Service", tillerNamespace, tillerName), func() error {
+			return client.CoreV1().Services(tillerNamespace).Delete(tillerName, getDeleteOptions())
+		}},
+		{namedObject(rbacAPIVersion, "ClusterRoleBinding", "", tillerAccount), func() error {
+			return client.RbacV1().ClusterRoleBindings().Delete(tillerAccount, getDeleteOptions())
+		}},
+		{namedObject("v1", "ServiceAccount", tillerNamespace, tillerAccount), func() error {
+			return client.CoreV1().ServiceAccounts(tillerNamespace).Delete(tillerAccount, getDeleteOptions())
+		}},
+	}
+	for _, d := range deletes {
+		if d.obj.Namespace == "" && !targetsClusterScope() {
+			continue
+		}
+		err := d.delete()
+		if errors.IsNotFound(err) {
+			continue
+		}
+		if err = recordDelete(d.obj, err); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return cleanupErrors(errs)
+	}
+	return nil
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/rancher/types/config"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+	apiextv1beta1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+)
+
+// inventoryObject is a rancher object along with the resource it is served
+// as, the dynamic client needs both to recreate it.
+type inventoryObject struct {
+	Resource   string                     `json:"resource"`
+	Namespaced bool                       `json:"namespaced,omitempty"`
+	Object     *unstructured.Unstructured `json:"object"`
+}
+
+// inventory is the rancher footprint of a cluster, discovered once and
+// shared by --diff, --backup-file and the backup, check and restore commands
+// so they all see the same objects. The cleanup steps list what they delete
+// on their own, the inventory is a snapshot of the cluster and not the plan
+// of a run, see removableFootprint.
+type inventory struct {
+	TakenAt time.Time         `json:"takenAt"`
+	Items   []inventoryObject `json:"items"`
+}
+
+var (
+	namespacesResource   = &v1.APIResource{Name: "namespaces", Kind: "Namespace"}
+	crdsResource         = &v1.APIResource{Name: "customresourcedefinitions", Kind: "CustomResourceDefinition"}
+	crdsGroupVersion     = schema.GroupVersion{Group: "apiextensions.k8s.io", Version: "v1beta1"}
+	webhooksGroupVersion = schema.GroupVersion{Group: "admissionregistration.k8s.io", Version: "v1beta1"}
+)
+
+// takeInventory lists the rancher namespaces, the cattle custom resource
+// definitions and all their custom resources, the cattle cluster roles and
+// bindings and the rancher webhooks.
+func takeInventory(pool dynamic.ClientPool) (*inventory, error) {
+	inv := &inventory{TakenAt: time.Now()}
+
+	namespaces, err := listObjects(pool, schema.GroupVersion{Version: "v1"}, namespacesResource, v1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for i := range namespaces {
+		if name := namespaces[i].GetName(); isRancherNamespace(name) || hasAnyPrefix(name, rancherNamespacePrefixes) {
+			inv.add(namespacesResource, &namespaces[i])
+		}
+	}
+
+	crds, err := listObjects(pool, crdsGroupVersion, crdsResource, v1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for i := range crds {
+		crd := apiextv1beta1.CustomResourceDefinition{}
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(crds[i].Object, &crd); err != nil {
+			return nil, err
+		}
+		if !isCattleGroup(crd.Spec.Group) {
+			continue
+		}
+		inv.add(crdsResource, &crds[i])
+		items, err := getCustomResourceList(pool, crd, v1.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		resource := &v1.APIResource{Name: crd.Spec.Names.Plural, Kind: crd.Spec.Names.Kind, Namespaced: crd.Spec.Scope == apiextv1beta1.NamespaceScoped}
+		for i := range items {
+			inv.add(resource, &items[i])
+		}
+	}
+
+	clusterRolesResource := &v1.APIResource{Name: "clusterroles", Kind: "ClusterRole"}
+	clusterRoles, err := listObjects(pool, rbacGroupVersion, clusterRolesResource, v1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for i := range clusterRoles {
+		if clusterRoles[i].GetLabels()["cattle.io/creator"] == "norman" || isStaticClusterRole(clusterRoles[i].GetName()) {
+			inv.add(clusterRolesResource, &clusterRoles[i])
+		}
+	}
+	clusterRoleBindingsResource := &v1.APIResource{Name: "clusterrolebindings", Kind: "ClusterRoleBinding"}
+	clusterRoleBindings, err := listObjects(pool, rbacGroupVersion, clusterRoleBindingsResource, cattleListOptions)
+	if err != nil {
+		return nil, err
+	}
+	for i := range clusterRoleBindings {
+		inv.add(clusterRoleBindingsResource, &clusterRoleBindings[i])
+	}
+
+	for _, resource := range []*v1.APIResource{
+		{Name: "validatingwebhookconfigurations", Kind: "ValidatingWebhookConfiguration"},
+		{Name: "mutatingwebhookconfigurations", Kind: "MutatingWebhookConfiguration"},
+	} {
+		webhooks, err := listObjects(pool, webhooksGroupVersion, resource, v1.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		for i := range webhooks {
+			if name := webhooks[i].GetName(); strings.Contains(name, "rancher") || strings.Contains(name, "cattle") {
+				inv.add(resource, &webhooks[i])
+			}
+		}
+	}
+	return inv, nil
+}
+
+func (inv *inventory) add(resource *v1.APIResource, obj *unstructured.Unstructured) {
+	inv.Items = append(inv.Items, inventoryObject{Resource: resource.Name, Namespaced: resource.Namespaced, Object: obj})
+}
+
+// footprint returns the objects of the inventory, each formatted as
+// "<kind> <namespace/name>".
+func (inv *inventory) footprint() sets.String {
+	footprint := sets.NewString()
+	for _, item := range inv.Items {
+		footprint.Insert(footprintEntry(item.Object))
+	}
+	return footprint
+}
+
+func footprintEntry(obj *unstructured.Unstructured) string {
+	return obj.GetKind() + " " + namespacedName(obj.GetNamespace(), obj.GetName())
+}
+
+func (inv *inventory) write(path string) error {
+	data, err := json.Marshal(inv)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+func readInventory(path string) (*inventory, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	inv := &inventory{}
+	if err := json.Unmarshal(data, inv); err != nil {
+		return nil, fmt.Errorf("reading inventory [%s]: %v", path, err)
+	}
+	return inv, nil
+}
+
+// restore recreates the objects of the inventory that are missing, namespaces
+// and custom resource definitions first so the rest has somewhere to go.
+func (inv *inventory) restore(pool dynamic.ClientPool) error {
+	errs := []error{}
+	for _, first := range []bool{true, false} {
+		for _, item := range inv.Items {
+			kind := item.Object.GetKind()
+			if (kind == "Namespace" || kind == "CustomResourceDefinition") != first {
+				continue
+			}
+			if err := restoreObject(pool, item); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return cleanupErrors(errs)
+	}
+	return nil
+}
+
+func restoreObject(pool dynamic.ClientPool, item inventoryObject) error {
+	obj := item.Object.DeepCopy()
+	gv, err := schema.ParseGroupVersion(obj.GetAPIVersion())
+	if err != nil {
+		return err
+	}
+	for _, field := range []string{"uid", "resourceVersion", "selfLink", "creationTimestamp", "deletionTimestamp", "deletionGracePeriodSeconds", "generation"} {
+		unstructured.RemoveNestedField(obj.Object, "metadata", field)
+	}
+	logrus.Infof("restoring %s [%s]..", obj.GetKind(), namespacedName(obj.GetNamespace(), obj.GetName()))
+	// custom resources are not served until their definition is established
+	err = wait.PollImmediate(2*time.Second, time.Minute, func() (bool, error) {
+		client, resource, err := resourceClient(pool, gv.WithKind(obj.GetKind()))
+		if meta.IsNoMatchError(err) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		_, err = client.Resource(resource, obj.GetNamespace()).Create(obj)
+		if errors.IsNotFound(err) {
+			return false, nil
+		}
+		return true, err
+	})
+	if errors.IsAlreadyExists(err) {
+		return nil
+	}
+	return err
+}
+
+func listObjects(pool dynamic.ClientPool, gv schema.GroupVersion, resource *v1.APIResource, opts v1.ListOptions) ([]unstructured.Unstructured, error) {
+	client, resource, err := resourceClient(pool, gv.WithKind(resource.Kind))
+	if meta.IsNoMatchError(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	obj, err := client.Resource(resource, "").List(opts)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	list, ok := obj.(*unstructured.UnstructuredList)
+	if !ok {
+		return nil, fmt.Errorf("unexpected list type %T for %s", obj, resource.Name)
+	}
+	return list.Items, nil
+}
+
+// getInventory connects to the cluster and takes its inventory.
+func getInventory(ctx *cli.Context) (*inventory, error) {
+	kubeContext = ctx.GlobalString("context")
+	restConfig, err := getRestConfig(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := newClientPool(restConfig)
+	if err != nil {
+		return nil, err
+	}
+	return takeInventory(pool)
+}
+
+// doBackup writes the inventory of the cluster to --file.
+func doBackup(ctx *cli.Context) error {
+	inv, err := getInventory(ctx)
+	if err != nil {
+		return err
+	}
+	if err := inv.write(ctx.String("file")); err != nil {
+		return err
+	}
+	logrus.Infof("backed up %d rancher objects to [%s]", len(inv.Items), ctx.String("file"))
+	return nil
+}
+
+// doCheck prints the rancher objects a cleanup with the same flags removes,
+// it fails when there are any left. Kept clusters and users and what the
+// cleanup leaves in place on purpose do not count.
+func doCheck(ctx *cli.Context) error {
+	kubeContext = ctx.GlobalString("context")
+	if err := setRunScope(ctx); err != nil {
+		return err
+	}
+	restConfig, err := getRestConfig(ctx, nil)
+	if err != nil {
+		return err
+	}
+	management, err := config.NewManagementContext(*restConfig)
+	if err != nil {
+		return err
+	}
+	k8sClient, err := getClientSet(ctx, nil)
+	if err != nil {
+		return err
+	}
+	servedGroups, err = getServedGroups(k8sClient)
+	if err != nil {
+		return err
+	}
+	if _, err := setRunComponents(ctx, k8sClient); err != nil {
+		return err
+	}
+	if _, _, _, err := setRunKeptObjects(ctx, management); err != nil {
+		return err
+	}
+	pool, err := newClientPool(restConfig)
+	if err != nil {
+		return err
+	}
+	inv, err := takeInventory(pool)
+	if err != nil {
+		return err
+	}
+	footprint := inv.removableFootprint()
+	if kept := inv.footprint().Difference(footprint); kept.Len() > 0 {
+		logrus.Infof("%d rancher objects are left in place on purpose", kept.Len())
+	}
+	if footprint.Len() == 0 {
+		fmt.Println("no rancher objects found")
+		return nil
+	}
+	for _, obj := range footprint.List() {
+		fmt.Println(obj)
+	}
+	return fmt.Errorf("%d rancher objects found", footprint.Len())
+}
+
+// doRestore recreates the objects of the inventory in --file.
+func doRestore(ctx *cli.Context) error {
+	inv, err := readInventory(ctx.String("file"))
+	if err != nil {
+		return err
+	}
+	kubeContext = ctx.GlobalString("context")
+	restConfig, err := getRestConfig(ctx, nil)
+	if err != nil {
+		return err
+	}
+	pool, err := newClientPool(restConfig)
+	if err != nil {
+		return err
+	}
+	return inv.restore(pool)
+}
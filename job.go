@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/urfave/cli"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const jobName = "rmrancher"
+
+func doGenerateJob(ctx *cli.Context) error {
+	namespace := ctx.String("job-namespace")
+	args := []string{"rmrancher"}
+	if ctx.Bool("controller") {
+		args = append(args, "controller")
+	}
+	args = append(args, getRemoveArgs(ctx)...)
+	verbs := []string{"get", "list", "watch", "update", "patch", "delete", "deletecollection"}
+	if ctx.Bool("deny-recreation") || ctx.Bool("snapshot") {
+		// the guard webhook configuration and the backup are created by the job
+		verbs = append(verbs, "create")
+	}
+	objects := []runtime.Object{
+		&corev1.ServiceAccount{
+			TypeMeta: v1.TypeMeta{
+				APIVersion: "v1",
+				Kind:       "ServiceAccount",
+			},
+			ObjectMeta: v1.ObjectMeta{
+				Name:      jobName,
+				Namespace: namespace,
+			},
+		},
+		&rbacv1.ClusterRole{
+			TypeMeta: v1.TypeMeta{
+				APIVersion: "rbac.authorization.k8s.io/v1",
+				Kind:       "ClusterRole",
+			},
+			ObjectMeta: v1.ObjectMeta{
+				Name: jobName,
+			},
+			Rules: []rbacv1.PolicyRule{
+				{
+					APIGroups: []string{"*"},
+					Resources: []string{"*"},
+					Verbs:     verbs,
+				},
+			},
+		},
+		&rbacv1.ClusterRoleBinding{
+			TypeMeta: v1.TypeMeta{
+				APIVersion: "rbac.authorization.k8s.io/v1",
+				Kind:       "ClusterRoleBinding",
+			},
+			ObjectMeta: v1.ObjectMeta{
+				Name: jobName,
+			},
+			RoleRef: rbacv1.RoleRef{
+				APIGroup: "rbac.authorization.k8s.io",
+				Kind:     "ClusterRole",
+				Name:     jobName,
+			},
+			Subjects: []rbacv1.Subject{
+				{
+					Kind:      "ServiceAccount",
+					Name:      jobName,
+					Namespace: namespace,
+				},
+			},
+		},
+		&batchv1.Job{
+			TypeMeta: v1.TypeMeta{
+				APIVersion: "batch/v1",
+				Kind:       "Job",
+			},
+			ObjectMeta: v1.ObjectMeta{
+				Name:      jobName,
+				Namespace: namespace,
+			},
+			Spec: batchv1.JobSpec{
+				BackoffLimit: new(int32),
+				Template: corev1.PodTemplateSpec{
+					Spec: corev1.PodSpec{
+						ServiceAccountName: jobName,
+						RestartPolicy:      corev1.RestartPolicyNever,
+						Containers: []corev1.Container{
+							{
+								Name:  jobName,
+								Image: ctx.String("image"),
+								Args:  args,
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	for _, obj := range objects {
+		data, err := yaml.Marshal(obj)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stdout, "---\n%s", data)
+	}
+	return nil
+}
+
+// getRemoveArgs returns the command line arguments for the remove flags that
+// were set on ctx.
+func getRemoveArgs(ctx *cli.Context) []string {
+	args := []string{}
+	for _, flag := range removeFlags {
+		name := strings.Split(flag.GetName(), ",")[0]
+		if !ctx.IsSet(name) {
+			continue
+		}
+		if _, ok := flag.(cli.StringSliceFlag); ok {
+			for _, value := range ctx.StringSlice(name) {
+				args = append(args, fmt.Sprintf("--%s=%s", name, value))
+			}
+			continue
+		}
+		args = append(args, fmt.Sprintf("--%s=%s", name, ctx.String(name)))
+	}
+	return args
+}
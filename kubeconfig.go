@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/rancher/types/config"
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// getRancherServerURL returns the server-url setting of rancher, it is empty
+// when rancher was never configured or is already gone.
+func getRancherServerURL(mgmtCtx *config.ManagementContext) (string, error) {
+	setting, err := mgmtCtx.Management.Settings("").Get("server-url", v1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	return setting.Value, nil
+}
+
+// pruneKubeconfig removes the clusters, contexts and users of the kubeconfig
+// at path that point at the rancher server at serverURL.
+func pruneKubeconfig(path, serverURL string) error {
+	serverURL = strings.TrimSuffix(serverURL, "/")
+	if serverURL == "" {
+		logrus.Warnf("rancher server url is unknown, not pruning kubeconfig [%s]", path)
+		return nil
+	}
+	kubeConfig, err := clientcmd.LoadFromFile(path)
+	if err != nil {
+		return err
+	}
+	removedClusters := map[string]bool{}
+	for name, cluster := range kubeConfig.Clusters {
+		if cluster.Server != serverURL && !strings.HasPrefix(cluster.Server, serverURL+"/") {
+			continue
+		}
+		if keepClusters[strings.TrimPrefix(cluster.Server, serverURL+"/k8s/clusters/")] {
+			continue
+		}
+		logrus.Infof("removing cluster [%s] from kubeconfig [%s]", name, path)
+		delete(kubeConfig.Clusters, name)
+		removedClusters[name] = true
+	}
+	removedAuthInfos := map[string]bool{}
+	for name, context := range kubeConfig.Contexts {
+		if !removedClusters[context.Cluster] {
+			continue
+		}
+		logrus.Infof("removing context [%s] from kubeconfig [%s]", name, path)
+		delete(kubeConfig.Contexts, name)
+		removedAuthInfos[context.AuthInfo] = true
+		if kubeConfig.CurrentContext == name {
+			kubeConfig.CurrentContext = ""
+		}
+	}
+	// users shared with contexts of other servers are kept
+	for _, context := range kubeConfig.Contexts {
+		delete(removedAuthInfos, context.AuthInfo)
+	}
+	for name := range removedAuthInfos {
+		logrus.Infof("removing user [%s] from kubeconfig [%s]", name, path)
+		delete(kubeConfig.AuthInfos, name)
+	}
+	return clientcmd.WriteToFile(*kubeConfig, path)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"github.com/rancher/types/config"
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// deleteMachines destroys the instances of the nodes rancher provisioned
+// through node drivers before their clusters are removed, see
+// --delete-machines.
+var deleteMachines bool
+
+// machineConfigKey is the key of the secret holding the docker machine
+// directory of a node, a base64 encoded tar.gz.
+const machineConfigKey = "extractedConfig"
+
+// machineConfigNamespaces are searched for the machine config secret of a
+// node after the namespace of its cluster, where it is kept depends on the
+// rancher version.
+var machineConfigNamespaces = []string{"cattle-global-data", cattleNamespace}
+
+// machinesCleanup destroys the instances of the node driver nodes of the
+// removed clusters with docker-machine, the node drivers have to be on the
+// PATH as docker-machine-driver-<name>.
+func machinesCleanup(mgmtCtx *config.ManagementContext, client *kubernetes.Clientset) error {
+	nodeList, err := mgmtCtx.Management.Nodes("").List(v1.ListOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	errs := []error{}
+	for _, node := range nodeList.Items {
+		if node.Spec.NodeTemplateName == "" || keepClusters[node.Namespace] || skipNamespace(node.Namespace) {
+			continue
+		}
+		if err := destroyMachine(client, node); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return cleanupErrors(errs)
+	}
+	return nil
+}
+
+// destroyMachine restores the docker machine directory of node and removes
+// the machines in it.
+func destroyMachine(client *kubernetes.Clientset, node v3.Node) error {
+	obj := namedObject("docker-machine", "Machine", node.Namespace, node.Spec.RequestedHostname)
+	data, err := getMachineConfig(client, node)
+	if err != nil {
+		return recordMachineDelete(obj, err)
+	}
+	if data == nil {
+		logrus.Warnf("no machine config found for node [%s], destroy its instance [%s] by hand", namespacedName(node.Namespace, node.Name), node.Spec.RequestedHostname)
+		recordSkip(obj, "no machine config")
+		return nil
+	}
+	dir, err := ioutil.TempDir("", "rmrancher-machine-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	if err := extractMachineConfig(data, dir); err != nil {
+		return recordMachineDelete(obj, err)
+	}
+	configs, err := filepath.Glob(filepath.Join(dir, "machines", "*", "config.json"))
+	if err != nil {
+		return err
+	}
+	errs := []error{}
+	for _, path := range configs {
+		name := filepath.Base(filepath.Dir(path))
+		obj := namedObject("docker-machine", "Machine", node.Namespace, name)
+		driver, err := relocateMachineConfig(path, dir)
+		if err != nil {
+			errs = append(errs, recordMachineDelete(obj, err))
+			continue
+		}
+		logrus.Infof("destroying %s machine [%s] of node [%s]..", driver, name, namespacedName(node.Namespace, node.Name))
+		out, err := exec.Command("docker-machine", "--storage-path", dir, "rm", "-f", "-y", name).CombinedOutput()
+		if err != nil {
+			err = fmt.Errorf("docker-machine rm %s: %v: %s", name, err, strings.TrimSpace(string(out)))
+		}
+		if err = recordMachineDelete(obj, err); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return cleanupErrors(errs)
+	}
+	return nil
+}
+
+// getMachineConfig returns the machine config of node, nil when there is
+// none.
+func getMachineConfig(client *kubernetes.Clientset, node v3.Node) ([]byte, error) {
+	for _, namespace := range append([]string{node.Namespace}, machineConfigNamespaces...) {
+		secret, err := client.CoreV1().Secrets(namespace).Get(node.Name, v1.GetOptions{})
+		if errors.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if data, ok := secret.Data[machineConfigKey]; ok {
+			return data, nil
+		}
+	}
+	return nil, nil
+}
+
+// extractMachineConfig unpacks the machine config data into dir.
+func extractMachineConfig(data []byte, dir string) error {
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		decoded = data
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(decoded))
+	if err != nil {
+		return fmt.Errorf("invalid machine config: %v", err)
+	}
+	defer gz.Close()
+	archive := tar.NewReader(gz)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("invalid machine config: %v", err)
+		}
+		target := filepath.Join(dir, header.Name)
+		if !strings.HasPrefix(target, dir+string(os.PathSeparator)) {
+			return fmt.Errorf("invalid machine config: path [%s] leaves the machine directory", header.Name)
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0700); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+				return err
+			}
+			file, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(header.Mode).Perm())
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(file, archive)
+			file.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// relocateMachineConfig points the paths of the machine config at path, which
+// are those of the rancher pod that created it, into dir. It returns the
+// driver of the machine.
+func relocateMachineConfig(path, dir string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	machine := struct {
+		DriverName string
+		Driver     struct {
+			StorePath string
+		}
+	}{}
+	if err := json.Unmarshal(data, &machine); err != nil {
+		return "", fmt.Errorf("invalid machine config: %v", err)
+	}
+	if storePath := machine.Driver.StorePath; storePath != "" && storePath != dir {
+		data = bytes.Replace(data, []byte(storePath), []byte(dir), -1)
+		if err := ioutil.WriteFile(path, data, 0600); err != nil {
+			return "", err
+		}
+	}
+	return machine.DriverName, nil
+}
@@ -2,24 +2,46 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
+	"os/exec"
+	"regexp"
 	"strings"
+	"time"
 
+	"github.com/rancher/norman/types/slice"
 	"github.com/rancher/types/apis/management.cattle.io/v3"
 	"github.com/rancher/types/config"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
-	"k8s.io/client-go/tools/clientcmd"
 )
 
 const (
-	CattleControllerName   = "controller.cattle.io"
-	DefaultCattleNamespace = "cattle-system"
-	CattleLabelBase        = "cattle.io"
+	CattleControllerName      = "controller.cattle.io"
+	DefaultCattleNamespace    = "cattle-system"
+	CattleLabelBase           = "cattle.io"
+	CattleGlobalDataNamespace = "cattle-global-data"
+)
+
+const (
+	managementAPIVersion = "management.cattle.io/v3"
+	rbacAPIVersion       = "rbac.authorization.k8s.io/v1"
+)
+
+const (
+	PhaseUsers      = "users"
+	PhaseClusters   = "clusters"
+	PhaseProjects   = "projects"
+	PhaseRBAC       = "rbac"
+	PhaseNamespaces = "namespaces"
+	PhaseCRDs       = "crds"
 )
 
 var VERSION = "v0.0.1-dev"
@@ -36,35 +58,611 @@ var cattleListOptions = v1.ListOptions{
 }
 var deletePolicy = v1.DeletePropagationBackground
 
+// propagationPolicies maps the --propagation-policy values to their
+// kubernetes deletion propagation.
+var propagationPolicies = map[string]v1.DeletionPropagation{
+	"background": v1.DeletePropagationBackground,
+	"foreground": v1.DeletePropagationForeground,
+	"orphan":     v1.DeletePropagationOrphan,
+}
+
+// gracePeriod is the grace period in seconds applied to every deletion.
+var gracePeriod int64
+
+var phases = []string{PhaseUsers, PhaseClusters, PhaseProjects, PhaseRBAC, PhaseNamespaces, PhaseCRDs}
+
+// onlyPhase restricts the cleanup to a single phase when set.
+var onlyPhase string
+
+// preserveWorkloads limits namespace deletion to the namespaces rancher
+// deploys itself into, see isRancherNamespace.
+var preserveWorkloads bool
+
+// includeProjectNamespaces deletes the namespaces of removed projects too,
+// otherwise only namespaces rancher created are deleted, see
+// isRancherCreatedNamespace.
+var includeProjectNamespaces bool
+
+// rancherCreatedNamespaces are the namespaces rancher created without a
+// rancher prefix, like the ones of the removed components and users.
+var rancherCreatedNamespaces = map[string]bool{}
+
+// protectedNamespaces are never modified by the cleanup passes.
+var protectedNamespaces = map[string]bool{}
+
+// keepClusters are the downstream clusters that stay registered, their
+// namespaces, projects and rbac are left in place, see --keep-cluster.
+var keepClusters = map[string]bool{}
+
+// keptIDs are the ids of the kept clusters and of their projects.
+var keptIDs []string
+
+// keepUsers are the rancher users left in place along with their
+// namespaces, see --keep-user and --include-admin-users.
+var keepUsers = map[string]bool{}
+
+// servedGroups are the api groups served by the cluster when the cleanup
+// starts, phases depending on absent groups are skipped.
+var servedGroups = sets.NewString()
+
+// targetNamespaces limits every cleanup pass to these namespaces when set,
+// cluster scoped objects are left alone, see --target-namespaces.
+var targetNamespaces = map[string]bool{}
+
+// defaultFinalizerPatterns match the finalizers of every known cattle
+// controller, --finalizer-pattern adds to them.
+var defaultFinalizerPatterns = []string{
+	regexp.QuoteMeta(CattleControllerName),
+	`wrangler\.cattle\.io`,
+	`fleet\.cattle\.io`,
+	`clusterscan`,
+}
+
+// finalizerPatterns match the finalizers stripped by cleanupFinalizers.
+var finalizerPatterns = compileFinalizerPatterns(defaultFinalizerPatterns)
+
+// defaultMetadataPrefixes are the prefixes of the label and annotation keys
+// set by rancher, --metadata-prefix adds to them.
+var defaultMetadataPrefixes = []string{
+	CattleLabelBase + "/",
+	"field.cattle.io/",
+	"management.cattle.io/",
+	"authz.management.cattle.io/",
+	"lifecycle.cattle.io/",
+	"clusterscoped.controller.cattle.io/",
+	"objectset.rio.cattle.io/",
+	"project.cattle.io/",
+	"cluster.cattle.io/",
+	"auth.cattle.io/",
+	"catalog.cattle.io/",
+	"provisioning.cattle.io/",
+	"rke.cattle.io/",
+}
+
+// metadataPrefixes are the prefixes of the label and annotation keys stripped
+// by cleanupAnnotationsLabels.
+var metadataPrefixes = defaultMetadataPrefixes
+
+// removeFlags configure the cleanup, they are shared by every command that
+// runs, schedules or checks it.
+var removeFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "namespace,n",
+		Usage: "rancher 2.0 deployment namespace. default is `cattle-system`",
+	},
+	cli.StringFlag{
+		Name:  "only",
+		Usage: "only run one cleanup phase: " + strings.Join(phases, "|"),
+	},
+	cli.BoolFlag{
+		Name:  "detach-projects",
+		Usage: "only detach every namespace from its project by stripping the project annotations, labels and cattle finalizers, nothing is deleted",
+	},
+	cli.BoolFlag{
+		Name:  "include-project-namespaces",
+		Usage: "also delete the namespaces of removed projects and any other namespace rancher did not create, only rancher created namespaces are deleted by default",
+	},
+	cli.BoolFlag{
+		Name:  "preserve-workloads",
+		Usage: "detach an imported cluster without deleting any workload namespace, only rancher's own namespaces are removed",
+	},
+	cli.StringFlag{
+		Name:  "strategy",
+		Value: StrategyForce,
+		Usage: "graceful leaves finalizers to their controllers and waits for a running rancher to process deletions, force strips finalizers and deletes immediately: graceful|force",
+	},
+	cli.Int64Flag{
+		Name:  "grace-period",
+		Usage: "grace period in seconds for every deletion, 0 deletes immediately, the default of every object with the graceful strategy",
+	},
+	cli.StringFlag{
+		Name:  "propagation-policy",
+		Usage: "propagation policy for every deletion: background|foreground|orphan",
+		Value: "background",
+	},
+	cli.StringFlag{
+		Name:  "target-namespaces",
+		Usage: "comma separated namespaces to limit the cleanup to, cluster scoped objects are not touched",
+	},
+	cli.StringSliceFlag{
+		Name:  "keep-cluster",
+		Usage: "id of a downstream cluster to keep registered along with its namespaces, projects and rbac, can be repeated",
+	},
+	cli.StringSliceFlag{
+		Name:  "keep-user",
+		Usage: "id of a rancher user to keep, can be repeated",
+	},
+	cli.BoolFlag{
+		Name:  "delete-machines",
+		Usage: "destroy the instances of the nodes provisioned through node drivers with docker-machine before their clusters are removed, docker-machine and the node drivers have to be on the PATH",
+	},
+	cli.BoolFlag{
+		Name:  "delete-tiller",
+		Usage: "remove tiller from kube-system along with the helm 2 release of rancher, unless it manages other releases",
+	},
+	cli.StringFlag{
+		Name:  "dns-provider",
+		Usage: "delete the dns records of the rancher hostname once its load balancer is gone, through route53, cloudflare or webhook. Credentials are read from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN, CLOUDFLARE_API_TOKEN or DNS_WEBHOOK_TOKEN",
+	},
+	cli.StringFlag{
+		Name:  "dns-hostname",
+		Usage: "hostname whose dns records --dns-provider deletes, the host of the rancher server url when not set",
+	},
+	cli.StringFlag{
+		Name:  "dns-webhook-url",
+		Usage: "url the webhook dns provider posts {\"action\": \"delete\", \"hostname\": <hostname>} to",
+	},
+	cli.BoolFlag{
+		Name:  "delete-dangling-bindings",
+		Usage: "delete the rbac bindings left referencing removed rancher users, or drop those users from their subjects, they are only reported otherwise",
+	},
+	cli.BoolFlag{
+		Name:  "include-admin-users",
+		Usage: "also remove users with the admin global role, they are kept by default",
+	},
+	cli.BoolFlag{
+		Name:  "watch",
+		Usage: "keep stripping finalizers re-added by rancher controllers to objects being deleted until they are gone",
+	},
+	cli.BoolFlag{
+		Name:  "deny-recreation",
+		Usage: "install a validating webhook denying the creation of cattle objects, and of workloads, secrets and rbac in the rancher namespaces, while the cleanup runs",
+	},
+	cli.BoolFlag{
+		Name:  "snapshot",
+		Usage: "create a rancher-backup or velero backup and wait for it before anything is deleted, rancher-backup is then kept along with its namespace and backups",
+	},
+	cli.BoolFlag{
+		Name:  "no-snapshot",
+		Usage: "continue without a backup when --snapshot finds neither rancher-backup nor velero",
+	},
+	cli.DurationFlag{
+		Name:  "snapshot-timeout",
+		Value: 30 * time.Minute,
+		Usage: "how long to wait for the --snapshot backup to complete",
+	},
+	cli.StringSliceFlag{
+		Name:  "finalizer-pattern",
+		Usage: "regular expression matching more finalizers to strip on top of the cattle defaults, can be repeated",
+	},
+	cli.StringSliceFlag{
+		Name:  "metadata-prefix",
+		Usage: "label and annotation key prefix to strip on top of the cattle defaults, like example.cattle.io/, can be repeated",
+	},
+	cli.DurationFlag{
+		Name:  "object-timeout",
+		Usage: "give up on an api request for a single object after this long, record the failure and carry on, no limit when not set",
+	},
+	cli.DurationFlag{
+		Name:  "phase-timeout",
+		Usage: "give up on a cleanup phase after this long, record the failure and carry on with the next one, no limit when not set",
+	},
+	cli.StringFlag{
+		Name:  "field-selector",
+		Usage: "field selector limiting the sweeps over namespaced objects, like metadata.namespace!=kube-system",
+	},
+	cli.StringFlag{
+		Name:  "dead-webhooks",
+		Value: DeadWebhooksWarn,
+		Usage: "what to do with webhooks failing closed whose service is gone or not ready: warn|ignore|delete, ignore sets their failure policy to Ignore",
+	},
+	cli.BoolFlag{
+		Name:  "delete-suspicious",
+		Usage: "delete objects matching the cattle selectors that don't look rancher created without asking",
+	},
+	cli.BoolFlag{
+		Name:  "include-monitoring",
+		Usage: "remove rancher monitoring, including its crds and cluster scoped objects",
+	},
+	cli.BoolFlag{
+		Name:  "include-logging",
+		Usage: "remove rancher logging, including its crds and cluster scoped objects",
+	},
+	cli.BoolFlag{
+		Name:  "include-istio",
+		Usage: "remove rancher managed istio, including its crds, sidecar webhooks and cluster scoped objects",
+	},
+	cli.BoolFlag{
+		Name:  "include-longhorn",
+		Usage: "remove longhorn, otherwise the longhorn-system namespace is never touched",
+	},
+	cli.BoolFlag{
+		Name:  "include-neuvector",
+		Usage: "remove neuvector, including its crds and admission webhooks",
+	},
+	cli.BoolFlag{
+		Name:  "keep-crds",
+		Usage: "keep the custom resource definitions for a reinstall, their custom resources are still removed and verified gone",
+	},
+	cli.BoolFlag{
+		Name:  "include-chart-crds",
+		Usage: "remove the crds of the charts rancher deployed, like monitoring, logging, istio and backup, that have no custom resources left",
+	},
+	cli.BoolFlag{
+		Name:  "include-cert-manager",
+		Usage: "remove the cert-manager certificates, issuers and cluster issuers of the rancher release, cert-manager itself is left in place",
+	},
+}
+
+// runFlags configure a single cleanup run, they are taken by the app and the
+// remove command.
+var runFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "prune-kubeconfig",
+		Usage: "remove the contexts, clusters and users pointing at the removed rancher server from this kubeconfig",
+	},
+	cli.StringFlag{
+		Name:  "report",
+		Usage: "write a json report of every deleted, updated, skipped and failed object to this file",
+	},
+	cli.StringFlag{
+		Name:  "audit-log",
+		Usage: "append a hash chained record of every deleted and updated object to this file",
+	},
+	cli.BoolFlag{
+		Name:  "diff",
+		Usage: "snapshot the rancher footprint before and after the cleanup and print what was removed and what remains",
+	},
+	cli.StringFlag{
+		Name:  "rancher-server-url",
+		Usage: "rancher server url used by --prune-kubeconfig and --rancher-api-token, read from the server-url setting when not set",
+	},
+	cli.StringFlag{
+		Name:  "backup-file",
+		Usage: "write the rancher objects found before the cleanup to this file, the restore command recreates them. Downstream contexts are written next to it, suffixed with the context name",
+	},
+	cli.BoolFlag{
+		Name:  "quiet,q",
+		Usage: "only print warnings, errors and the final summary, --report keeps every detail",
+	},
+}
+
 func main() {
 	app := cli.NewApp()
 	app.Name = "rmrancher"
 	app.Version = VERSION
 	app.Usage = "A tool to uninstall rancher 2.0 deployments"
-	app.Action = doRemoveRancher
-	app.Flags = []cli.Flag{
+	app.Action = doRemoveRancherContexts
+	app.EnableBashCompletion = true
+	app.Before = func(ctx *cli.Context) error {
+		setupColors(ctx.GlobalBool("no-color"))
+		startRunContext(ctx.GlobalDuration("timeout"))
+		return nil
+	}
+	app.Flags = append([]cli.Flag{
 		cli.StringFlag{
 			Name:   "kubeconfig,c",
 			EnvVar: "KUBECONFIG",
 			Usage:  "kubeconfig absolute path",
 		},
 		cli.StringFlag{
-			Name:  "namespace,n",
-			Usage: "rancher 2.0 deployment namespace. default is `cattle-system`",
+			Name:  "context",
+			Usage: "kubeconfig context of the rancher management cluster, the current context when not set",
+		},
+		cli.StringSliceFlag{
+			Name:  "contexts",
+			Usage: "downstream kubeconfig context to clean up after the management cluster, can be repeated",
+		},
+		cli.BoolFlag{
+			Name:  "all-contexts",
+			Usage: "clean up every other kubeconfig context as a downstream cluster after the management cluster",
+		},
+		cli.Float64Flag{
+			Name:  "kube-api-qps",
+			Usage: "maximum queries per second to the kubernetes api, client-go default when not set",
+		},
+		cli.IntFlag{
+			Name:  "kube-api-burst",
+			Usage: "maximum burst of queries to the kubernetes api, client-go default when not set",
+		},
+		cli.StringFlag{
+			Name:  "server",
+			Usage: "address of the kubernetes api server of the management cluster, overrides the one in the kubeconfig",
+		},
+		cli.StringFlag{
+			Name:  "certificate-authority",
+			Usage: "path to a ca bundle to verify the kubernetes api server of the management cluster with, instead of the one in the kubeconfig",
+		},
+		cli.BoolFlag{
+			Name:  "insecure-skip-tls-verify",
+			Usage: "do not verify the certificates of the kubernetes api servers, for labs with broken certificates only",
+		},
+		cli.StringFlag{
+			Name:  "as",
+			Usage: "user to impersonate for every kubernetes api request, like kubectl --as",
+		},
+		cli.StringSliceFlag{
+			Name:  "as-group",
+			Usage: "group to impersonate along with --as, can be repeated",
+		},
+		cli.BoolFlag{
+			Name:  "no-color",
+			Usage: "never color the output, it is only colored when attached to a terminal",
+		},
+		cli.DurationFlag{
+			Name:  "timeout",
+			Usage: "give up and cancel every pending api request after this long, no limit when not set",
+		},
+		cli.StringFlag{
+			Name:   "rancher-api-token",
+			EnvVar: "RANCHER_API_TOKEN",
+			Usage:  "api token of a running rancher, clusters, projects and users are deleted through its api first so nodes and cloud resources are torn down",
+		},
+		cli.DurationFlag{
+			Name:  "rancher-api-timeout",
+			Value: 30 * time.Minute,
+			Usage: "how long to wait for rancher to remove each object deleted through its api",
+		},
+	}, append(runFlags, removeFlags...)...)
+	app.Commands = []cli.Command{
+		{
+			Name:   "remove",
+			Usage:  "remove rancher, the same as running without a command",
+			Action: doRemoveRancherContexts,
+			Flags:  append(append([]cli.Flag{}, runFlags...), removeFlags...),
+		},
+		{
+			Name:   "generate-job",
+			Usage:  "print a job manifest that runs the cleanup from inside the cluster with the given flags",
+			Action: doGenerateJob,
+			Flags: append([]cli.Flag{
+				cli.StringFlag{
+					Name:  "image",
+					Value: "rancher/rmrancher:" + VERSION,
+					Usage: "rmrancher image used by the job",
+				},
+				cli.StringFlag{
+					Name:  "job-namespace",
+					Value: v1.NamespaceSystem,
+					Usage: "namespace the job and its service account are created in",
+				},
+				cli.BoolFlag{
+					Name:  "controller",
+					Usage: "run the cleanup in controller mode until no rancher footprint is left instead of a single pass",
+				},
+			}, removeFlags...),
+		},
+		{
+			Name:   "plan",
+			Usage:  "print the clusters, projects, namespaces, users and bindings the cleanup would remove",
+			Action: doPlan,
+			Flags: append([]cli.Flag{
+				cli.StringFlag{
+					Name:  "output,o",
+					Value: "text",
+					Usage: "plan format: text|script, script renders the plan as kubectl commands",
+				},
+				cli.StringFlag{
+					Name:  "from-dump",
+					Usage: "plan from a directory of exported yaml or json, like kubectl get -o yaml output or an extracted velero backup, instead of the cluster",
+				},
+			}, removeFlags...),
+		},
+		{
+			Name:   "controller",
+			Usage:  "repeat the cleanup until no rancher footprint is left, fails when a pass no longer changes what remains",
+			Action: doRunController,
+			Flags: append([]cli.Flag{
+				cli.DurationFlag{
+					Name:  "interval",
+					Value: 30 * time.Second,
+					Usage: "time to wait between cleanup passes",
+				},
+			}, removeFlags...),
+		},
+		{
+			Name:   "docker",
+			Usage:  "remove a single node rancher installed as a docker container",
+			Action: doRemoveDockerRancher,
+			Flags: []cli.Flag{
+				cli.StringSliceFlag{
+					Name:  "container",
+					Usage: "rancher container name or id, detected from the image when not set",
+				},
+				cli.StringFlag{
+					Name:  "image",
+					Value: "rancher/rancher",
+					Usage: "image used to detect the rancher container",
+				},
+				cli.StringFlag{
+					Name:  "data-dir",
+					Value: defaultRancherDataDir,
+					Usage: "rancher data directory on the host",
+				},
+				cli.BoolFlag{
+					Name:  "yes,y",
+					Usage: "remove the data directory without asking for confirmation",
+				},
+			},
+		},
+		{
+			Name:   "nodes",
+			Usage:  "clean up the hosts of rke provisioned clusters over ssh, run it before the clusters are removed",
+			Action: doCleanupNodes,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "ssh-key",
+					Usage: "private key used to connect to the nodes",
+				},
+				cli.StringFlag{
+					Name:  "ssh-user",
+					Usage: "ssh user, defaults to the user of the rke node config",
+				},
+				cli.StringFlag{
+					Name:  "ssh-strict-host-key-checking",
+					Value: "accept-new",
+					Usage: "value of the ssh StrictHostKeyChecking option",
+				},
+				cli.StringSliceFlag{
+					Name:  "cluster",
+					Usage: "only clean up the nodes of this cluster, can be repeated",
+				},
+				cli.BoolFlag{
+					Name:  "yes,y",
+					Usage: "clean up the nodes without asking for confirmation",
+				},
+			},
+		},
+		{
+			Name:   "backup",
+			Usage:  "write the rancher objects found in the cluster to a file",
+			Action: doBackup,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "file,f",
+					Value: "rancher-inventory.json",
+					Usage: "file the objects are written to",
+				},
+			},
 		},
+		{
+			Name:   "check",
+			Usage:  "list the rancher objects a cleanup with the same flags would remove, fails when there are any",
+			Action: doCheck,
+			Flags:  removeFlags,
+		},
+		{
+			Name:   "restore",
+			Usage:  "recreate the rancher objects of a backup that are missing from the cluster",
+			Action: doRestore,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "file,f",
+					Value: "rancher-inventory.json",
+					Usage: "file written by the backup command or --backup-file",
+				},
+			},
+		},
+		{
+			Name:      "completion",
+			Usage:     "print the shell completion script for bash, zsh or fish",
+			ArgsUsage: "bash|zsh|fish",
+			Action:    doCompletion,
+		},
+	}
+	app.BashComplete = completeFlags(app.Flags, true)
+	for i := range app.Commands {
+		app.Commands[i].BashComplete = completeFlags(app.Commands[i].Flags, false)
+	}
+	if completeFlagValue(os.Args) {
+		return
 	}
 
 	if err := app.Run(os.Args); err != nil {
+		logFailures(err)
 		logrus.Fatal(err)
 	}
 }
 
-func doRemoveRancher(ctx *cli.Context) error {
+func doRemoveRancher(ctx *cli.Context) (err error) {
+	if path := ctx.String("report"); path != "" {
+		defer func() {
+			if reportErr := report.write(path); reportErr != nil && err == nil {
+				err = reportErr
+			}
+		}()
+	}
+	apiStats.start()
+	defer func() {
+		report.addAPIStats(apiStats.finish())
+	}()
+	if path := ctx.String("audit-log"); path != "" {
+		user := getKubeconfigUser(ctx)
+		if as := ctx.GlobalString("as"); as != "" {
+			user += " as " + as
+		}
+		audit, err = openAuditLog(path, user)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if auditErr := audit.close(); auditErr != nil && err == nil {
+				err = auditErr
+			}
+			audit = nil
+		}()
+	}
 	// setup
-	if ctx.String("namespace") != "" {
-		cattleNamespace = ctx.String("namespace")
+	if err := setRunScope(ctx); err != nil {
+		return err
+	}
+	onlyPhase = ctx.String("only")
+	if onlyPhase != "" && !slice.ContainsString(phases, onlyPhase) {
+		return fmt.Errorf("invalid phase [%s], must be one of %s", onlyPhase, strings.Join(phases, "|"))
+	}
+	deleteDanglingBindings = ctx.Bool("delete-dangling-bindings")
+	deleteMachines = ctx.Bool("delete-machines")
+	if deleteMachines {
+		if _, err := exec.LookPath("docker-machine"); err != nil {
+			return fmt.Errorf("--delete-machines needs docker-machine on the PATH: %v", err)
+		}
 	}
-	restConfig, err := getRestConfig(ctx)
+	deleteTiller = ctx.Bool("delete-tiller")
+	dnsProviderName, dnsProvider, err := getDNSProvider(ctx)
+	if err != nil {
+		return err
+	}
+	strategy = ctx.String("strategy")
+	if err := validateStrategy(strategy); err != nil {
+		return err
+	}
+	if strategy == StrategyGraceful && ctx.Bool("detach-projects") {
+		return fmt.Errorf("--detach-projects strips finalizers, it needs the %s strategy", StrategyForce)
+	}
+	if strategy == StrategyGraceful && ctx.Bool("watch") {
+		return fmt.Errorf("--watch strips finalizers, it needs the %s strategy", StrategyForce)
+	}
+	gracePeriod = ctx.Int64("grace-period")
+	if !ctx.IsSet("grace-period") && strategy == StrategyGraceful {
+		gracePeriod = -1
+	} else if gracePeriod < 0 {
+		return fmt.Errorf("invalid grace period [%d], must not be negative", gracePeriod)
+	}
+	policy, ok := propagationPolicies[ctx.String("propagation-policy")]
+	if !ok {
+		return fmt.Errorf("invalid propagation policy [%s], must be one of background|foreground|orphan", ctx.String("propagation-policy"))
+	}
+	deletePolicy = policy
+	finalizerPatterns = compileFinalizerPatterns(defaultFinalizerPatterns)
+	for _, pattern := range ctx.StringSlice("finalizer-pattern") {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid finalizer pattern [%s]: %v", pattern, err)
+		}
+		finalizerPatterns = append(finalizerPatterns, re)
+	}
+	objectTimeout = ctx.Duration("object-timeout")
+	phaseTimeout = ctx.Duration("phase-timeout")
+	if objectTimeout < 0 || phaseTimeout < 0 {
+		return fmt.Errorf("timeouts must not be negative")
+	}
+	sweepListOptions = v1.ListOptions{FieldSelector: ctx.String("field-selector")}
+	if _, err := fields.ParseSelector(sweepListOptions.FieldSelector); err != nil {
+		return fmt.Errorf("invalid field selector [%s]: %v", sweepListOptions.FieldSelector, err)
+	}
+	metadataPrefixes = append(append([]string{}, defaultMetadataPrefixes...), ctx.StringSlice("metadata-prefix")...)
+	scope := newRequestScope()
+	restConfig, err := getRestConfig(ctx, scope)
 	if err != nil {
 		return err
 	}
@@ -72,90 +670,701 @@ func doRemoveRancher(ctx *cli.Context) error {
 	if err != nil {
 		return err
 	}
-	k8sClient, err := getClientSet(ctx)
+	k8sClient, err := getClientSet(ctx, scope)
 	if err != nil {
 		return err
 	}
-	// getting high-level crd lists
-	projects, err := getProjectList(management)
+	if ctx.Bool("detach-projects") {
+		logrus.Infof("detaching namespaces from their projects..")
+		return namespacesCleanup(k8sClient)
+	}
+	dynamicClientPool, err := newClientPool(restConfig)
 	if err != nil {
 		return err
 	}
-	clusters, err := getClusterList(management)
+	servedGroups, err = getServedGroups(k8sClient)
 	if err != nil {
 		return err
 	}
-	users, err := getUserList(management)
+	installType, err = detectInstall(k8sClient)
 	if err != nil {
 		return err
 	}
-	// starting cleanup
-	if err := namespacesCleanup(k8sClient); err != nil {
+	logrus.Infof("rancher install: %s", describeInstall(installType))
+	components, err := setRunComponents(ctx, k8sClient)
+	if err != nil {
 		return err
 	}
-
-	if err := secretsCleanup(k8sClient); err != nil {
+	if err := compatibilityCheck(k8sClient); err != nil {
 		return err
 	}
-
-	for _, project := range projects {
-		logrus.Infof("deleting project [%s]..", project.Name)
-		if err := deleteNamespace(k8sClient, project.Name); err != nil && !errors.IsNotFound(err) {
+	permissions := append(requiredPermissions, componentPermissions(components)...)
+	permissions = append(permissions, optionalPermissions(ctx)...)
+	if ctx.Bool("include-cert-manager") {
+		permissions = append(permissions, certManagerPermissions()...)
+	}
+	if err := preflightCheck(k8sClient, permissions); err != nil {
+		return err
+	}
+	if backupFile := ctx.String("backup-file"); ctx.Bool("diff") || backupFile != "" {
+		if backupFile != "" && inDownstreamContext {
+			backupFile = contextBackupFile(backupFile, kubeContext)
+		}
+		before, err := takeInventory(dynamicClientPool)
+		if err != nil {
 			return err
 		}
-		if err := deleteProject(management, project); err != nil && !errors.IsNotFound(err) {
+		if backupFile != "" {
+			if err := before.write(backupFile); err != nil {
+				return err
+			}
+			logrus.Infof("backed up %d rancher objects to [%s]", len(before.Items), backupFile)
+		}
+		if ctx.Bool("diff") {
+			defer func() {
+				after, inventoryErr := takeInventory(dynamicClientPool)
+				if inventoryErr != nil {
+					logrus.Errorf("failed to take the rancher footprint after cleanup: %v", inventoryErr)
+					return
+				}
+				printFootprintDiff(before.footprint(), after.footprint())
+			}()
+		}
+	}
+	serverURL := ctx.String("rancher-server-url")
+	apiToken := ctx.GlobalString("rancher-api-token")
+	dnsHostname := ctx.String("dns-hostname")
+	if (ctx.String("prune-kubeconfig") != "" || apiToken != "" || (dnsProvider != nil && dnsHostname == "")) && serverURL == "" && servedGroups.Has(managementGroup) {
+		serverURL, err = getRancherServerURL(management)
+		if err != nil {
 			return err
 		}
 	}
-	for _, cluster := range clusters {
-		logrus.Infof("deleting cluster [%s]..", cluster.Name)
-		if err := deleteNamespace(k8sClient, cluster.Name); err != nil && !errors.IsNotFound(err) {
+	if dnsHostname == "" {
+		dnsHostname = rancherHostname(serverURL)
+	}
+	// getting high-level crd lists
+	projects, clusters, users, err := setRunKeptObjects(ctx, management)
+	if err != nil {
+		return err
+	}
+	if ctx.Bool("snapshot") {
+		if !servedGroups.HasAny(rancherBackupGroup, veleroGroup) && ctx.Bool("no-snapshot") {
+			logrus.Warnf("neither rancher-backup nor velero is installed, continuing without a backup")
+		} else if err := takeSnapshot(dynamicClientPool, ctx.Duration("snapshot-timeout")); err != nil {
+			return err
+		}
+	}
+	if apiToken != "" {
+		if serverURL == "" {
+			return fmt.Errorf("rancher server url is unknown, set --rancher-server-url to use --rancher-api-token")
+		}
+		api := newRancherAPI(serverURL, apiToken)
+		if err := gracefulDeprovision(api, clusters, projects, users, ctx.GlobalDuration("rancher-api-timeout")); err != nil {
 			return err
 		}
-		if err := deleteCluster(management, cluster); err != nil && !errors.IsNotFound(err) {
+	}
+	if ctx.Bool("deny-recreation") {
+		// deferred removals are skipped when a second signal exits
+		atExit(func() {
+			removeRecreationGuard(k8sClient)
+		})
+		defer removeRecreationGuard(k8sClient)
+		if err := installRecreationGuard(k8sClient); err != nil {
 			return err
 		}
 	}
-	for _, user := range users {
-		logrus.Infof("deleting user [%s]..", user.Name)
-		if err := deleteNamespace(k8sClient, user.Name); err != nil && !errors.IsNotFound(err) {
+	if strategy == StrategyGraceful {
+		waitForControllers, err = rancherRunning(k8sClient)
+		if err != nil {
 			return err
 		}
-		if err := deleteUser(management, user); err != nil && !errors.IsNotFound(err) {
+		if !waitForControllers {
+			logrus.Warnf("rancher is not running, objects with cattle finalizers will not be removed by the %s strategy", StrategyGraceful)
+		}
+	}
+	if ctx.Bool("watch") {
+		watcher, err := startFinalizerWatcher(management.APIExtClient, dynamicClientPool)
+		if err != nil {
 			return err
 		}
+		defer watcher.stop()
+	}
+	// the cleanup graph, steps are declared in the order they ran in before the
+	// graph and only the constraints between them are listed
+	steps := []cleanupStep{
+		{
+			name: "dead-webhooks",
+			run: func() error {
+				return deadWebhooksCleanup(k8sClient)
+			},
+		},
+		{
+			// isolation policies are told by the cattle metadata the
+			// namespaced metadata pass strips
+			name:  "network-policies",
+			phase: PhaseNamespaces,
+			after: []string{"dead-webhooks"},
+			run: func() error {
+				return networkPoliciesCleanup(k8sClient)
+			},
+		},
+		{
+			// strip cattle metadata while the objects of the controllers are
+			// still around, and before their definitions are removed
+			name:  "namespaced-metadata",
+			phase: PhaseNamespaces,
+			after: []string{"dead-webhooks", "network-policies"},
+			run: func() error {
+				if err := namespacesCleanup(k8sClient); err != nil {
+					return err
+				}
+				if err := dataResourcesCleanup(k8sClient); err != nil {
+					return err
+				}
+				if err := persistentVolumeClaimsCleanup(k8sClient); err != nil {
+					return err
+				}
+				if targetsClusterScope() {
+					if err := persistentVolumesCleanup(k8sClient); err != nil {
+						return err
+					}
+				}
+				if err := kubeSystemCleanup(k8sClient, dynamicClientPool); err != nil {
+					return err
+				}
+				return namespacedResourcesCleanup(k8sClient, dynamicClientPool)
+			},
+		},
+		{
+			// component webhooks go before their custom resources
+			name:  "components",
+			phase: PhaseCRDs,
+			after: []string{"namespaced-metadata"},
+			run: func() error {
+				for _, c := range components {
+					if err := componentCleanup(k8sClient, management.APIExtClient, dynamicClientPool, c); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		},
+		{
+			// the components remove the custom resources of their charts
+			name:  "chart-crds",
+			phase: PhaseCRDs,
+			after: []string{"components", "cert-manager"},
+			run: func() error {
+				if !ctx.Bool("include-chart-crds") || !targetsClusterScope() {
+					return nil
+				}
+				logrus.Infof("removing chart crds..")
+				return chartCRDsCleanup(management.APIExtClient, dynamicClientPool)
+			},
+		},
+		{
+			name:  "cert-manager",
+			phase: PhaseCRDs,
+			after: []string{"namespaced-metadata"},
+			run: func() error {
+				if !ctx.Bool("include-cert-manager") {
+					return nil
+				}
+				logrus.Infof("removing cert-manager resources of the rancher release..")
+				return certManagerCleanup(management.APIExtClient, dynamicClientPool)
+			},
+		},
+		{
+			name:  "provisioning",
+			phase: PhaseCRDs,
+			after: []string{"namespaced-metadata"},
+			run: func() error {
+				return provisioningCleanup(management.APIExtClient, dynamicClientPool)
+			},
+		},
+		{
+			// provisioning clusters own the cluster api objects
+			name:  "capi",
+			phase: PhaseCRDs,
+			after: []string{"provisioning"},
+			run: func() error {
+				return capiCleanup(management.APIExtClient, dynamicClientPool)
+			},
+		},
+		{
+			name:  "management-resources",
+			phase: PhaseCRDs,
+			after: []string{"provisioning", "capi"},
+			run: func() error {
+				if !servedGroups.Has(managementGroup) {
+					return nil
+				}
+				return managementResourcesCleanup(management.APIExtClient, dynamicClientPool)
+			},
+		},
+		{
+			// catalog app finalizers block the deletion of project namespaces
+			name:  "project-resources",
+			phase: PhaseCRDs,
+			after: []string{"namespaced-metadata"},
+			run: func() error {
+				return projectResourcesCleanup(management.APIExtClient, dynamicClientPool)
+			},
+		},
+		{
+			name:  "projects",
+			phase: PhaseProjects,
+			after: []string{"management-resources", "project-resources"},
+			run: func() error {
+				memberNamespaces := map[string][]string{}
+				if includeProjectNamespaces {
+					var err error
+					if memberNamespaces, err = getProjectNamespaces(k8sClient); err != nil {
+						return err
+					}
+				}
+				for _, project := range projects {
+					if keepClusters[project.Namespace] {
+						logrus.Infof("keeping project [%s] of cluster [%s]", project.Name, project.Namespace)
+						recordSkip(objectOf(managementAPIVersion, "Project", &project), "cluster is kept")
+						continue
+					}
+					logrus.Infof("deleting project [%s]..", project.Name)
+					for _, namespace := range memberNamespaces[project.Namespace+":"+project.Name] {
+						logrus.Infof("deleting namespace [%s] of project [%s]..", namespace, project.Name)
+						if err := deleteNamespace(k8sClient, namespace); err != nil && !errors.IsNotFound(err) {
+							return err
+						}
+					}
+					if err := deleteNamespace(k8sClient, project.Name); err != nil && !errors.IsNotFound(err) {
+						return err
+					}
+					if skipNamespace(project.Namespace) {
+						continue
+					}
+					if err := deleteProject(management, project); err != nil && !errors.IsNotFound(err) {
+						return err
+					}
+				}
+				return nil
+			},
+		},
+		{
+			name:  "pipeline-namespaces",
+			phase: PhaseProjects,
+			after: []string{"project-resources"},
+			run: func() error {
+				return pipelineNamespacesCleanup(k8sClient)
+			},
+		},
+		{
+			// the machine configs go along with the cluster namespaces
+			name:  "machines",
+			phase: PhaseClusters,
+			run: func() error {
+				if !deleteMachines || !servedGroups.Has(managementGroup) {
+					return nil
+				}
+				return machinesCleanup(management, k8sClient)
+			},
+		},
+		{
+			// projects live in the namespaces of their clusters
+			name:  "clusters",
+			phase: PhaseClusters,
+			after: []string{"management-resources", "projects", "machines"},
+			run: func() error {
+				removedClusters := []v3.Cluster{}
+				for _, cluster := range clusters {
+					if keepClusters[cluster.Name] {
+						logrus.Infof("keeping cluster [%s]", cluster.Name)
+						recordSkip(objectOf(managementAPIVersion, "Cluster", &cluster), "cluster is kept")
+						continue
+					}
+					removedClusters = append(removedClusters, cluster)
+					if err := clusterCredentialsCleanup(k8sClient, cluster.Name); err != nil {
+						return err
+					}
+					if err := clusterRegistrationTokensCleanup(management, cluster.Name); err != nil {
+						return err
+					}
+					logrus.Infof("deleting cluster [%s]..", cluster.Name)
+					if err := deleteNamespace(k8sClient, cluster.Name); err != nil && !errors.IsNotFound(err) {
+						return err
+					}
+					if !targetsClusterScope() {
+						continue
+					}
+					if err := deleteCluster(management, cluster); err != nil && !errors.IsNotFound(err) {
+						return err
+					}
+				}
+				return clusterStateSecretsCleanup(k8sClient, removedClusters)
+			},
+		},
+		{
+			name:  "users",
+			phase: PhaseUsers,
+			after: []string{"management-resources", "clusters"},
+			run: func() error {
+				for _, user := range users {
+					if keepUsers[user.Name] {
+						logrus.Infof("keeping user [%s]", user.Name)
+						recordSkip(objectOf(managementAPIVersion, "User", &user), "user is kept")
+						continue
+					}
+					logrus.Infof("deleting user [%s]..", user.Name)
+					if err := userPreferencesCleanup(management, user.Name); err != nil {
+						return err
+					}
+					if err := deleteNamespace(k8sClient, user.Name); err != nil && !errors.IsNotFound(err) {
+						return err
+					}
+					if !targetsClusterScope() {
+						continue
+					}
+					if err := deleteUser(management, user); err != nil && !errors.IsNotFound(err) {
+						return err
+					}
+				}
+				return nil
+			},
+		},
+		{
+			name:  "auth-tokens",
+			phase: PhaseUsers,
+			after: []string{"users"},
+			run: func() error {
+				if !servedGroups.Has(managementGroup) {
+					return nil
+				}
+				logrus.Infof("deleting auth tokens..")
+				return authTokensCleanup(management.APIExtClient, dynamicClientPool)
+			},
+		},
+		{
+			name:  "auth-groups",
+			phase: PhaseUsers,
+			after: []string{"users"},
+			run: func() error {
+				if !servedGroups.Has(managementGroup) {
+					return nil
+				}
+				logrus.Infof("deleting auth provider groups..")
+				return groupResourcesCleanup(management.APIExtClient, dynamicClientPool, managementGroup, authGroupResources)
+			},
+		},
+		{
+			// the bindings of users, projects and clusters go once the
+			// controllers can no longer recreate them
+			name:  "cluster-rbac",
+			phase: PhaseRBAC,
+			after: []string{"users", "projects", "clusters"},
+			run: func() error {
+				if !targetsClusterScope() {
+					return nil
+				}
+				logrus.Infof("deleting cattle cluster roles and bindings..")
+				if err := cattleClusterRBACCleanup(dynamicClientPool); err != nil {
+					return err
+				}
+				for _, clusterRole := range staticClusterRoles {
+					logrus.Infof("deleting cluster role [%s]..", clusterRole)
+					if err := deleteClusterRole(k8sClient, clusterRole); err != nil && !errors.IsNotFound(err) {
+						return err
+					}
+				}
+				return nil
+			},
+		},
+		{
+			name:  "namespaced-rbac",
+			phase: PhaseRBAC,
+			after: []string{"cluster-rbac"},
+			run: func() error {
+				return namespacedRBACCleanup(dynamicClientPool)
+			},
+		},
+		{
+			// budgets left in the rancher namespaces block node drains
+			name:  "scaling-policies",
+			phase: PhaseNamespaces,
+			after: []string{"namespaced-metadata"},
+			run: func() error {
+				return scalingPoliciesCleanup(k8sClient)
+			},
+		},
+		{
+			// bindings the cattle selectors missed may still name removed users
+			name:  "dangling-bindings",
+			phase: PhaseRBAC,
+			after: []string{"users", "namespaced-rbac"},
+			run: func() error {
+				return danglingBindingsCleanup(k8sClient)
+			},
+		},
+		{
+			// the rancher deployment namespace goes last
+			name:  "final",
+			phase: PhaseNamespaces,
+			after: []string{"components", "cert-manager", "management-resources", "clusters", "namespaced-rbac", "scaling-policies"},
+			run: func() error {
+				if !skipNamespace(cattleNamespace) {
+					if err := networkingCleanup(k8sClient, cattleNamespace); err != nil {
+						return err
+					}
+				}
+				if err := certificateSecretsCleanup(k8sClient); err != nil {
+					return err
+				}
+				if err := helmReleaseCleanup(k8sClient); err != nil {
+					return err
+				}
+				logrus.Infof("removing rancher deployment namespace [%s]", cattleNamespace)
+				return deleteNamespace(k8sClient, cattleNamespace)
+			},
+		},
+		{
+			// the load balancer in front of rancher is gone along with its
+			// namespace
+			name:  "dns",
+			phase: PhaseNamespaces,
+			after: []string{"final"},
+			run: func() error {
+				if dnsProvider == nil || inDownstreamContext || !targetsClusterScope() {
+					return nil
+				}
+				return dnsCleanup(dnsProviderName, dnsProvider, dnsHostname)
+			},
+		},
+		{
+			name:  "prune-kubeconfig",
+			phase: PhaseClusters,
+			after: []string{"clusters", "final"},
+			run: func() error {
+				if path := ctx.String("prune-kubeconfig"); path != "" && targetsClusterScope() {
+					return pruneKubeconfig(path, serverURL)
+				}
+				return nil
+			},
+		},
 	}
+	if err := runSteps(steps, scope); err != nil {
+		return err
+	}
+	if installType == InstallSingleNode {
+		logrus.Warnf("rancher runs in a docker container and recreates what it needs, remove the container with `rmrancher docker` on its host")
+	}
+	if onlyPhase != "" || !targetsClusterScope() {
+		return nil
+	}
+	return verifyRancherGone(k8sClient)
+}
+
+// runPhase reports whether phase is part of this run, see --only.
+func runPhase(phase string) bool {
+	return onlyPhase == "" || onlyPhase == phase
+}
 
-	clusterRoles, err := getCattleClusterRolesList(k8sClient)
+// setRunScope sets the namespaces the run targets and protects and what it
+// deletes from the remove flags.
+func setRunScope(ctx *cli.Context) error {
+	protectedNamespaces = map[string]bool{}
+	targetNamespaces = parseTargetNamespaces(ctx)
+	keepClusters = map[string]bool{}
+	keepUsers = map[string]bool{}
+	if ctx.String("namespace") != "" {
+		cattleNamespace = ctx.String("namespace")
+	}
+	preserveWorkloads = ctx.Bool("preserve-workloads")
+	includeProjectNamespaces = ctx.Bool("include-project-namespaces")
+	rancherCreatedNamespaces = map[string]bool{}
+	deleteSuspicious = ctx.Bool("delete-suspicious")
+	keepCRDs = ctx.Bool("keep-crds")
+	deadWebhooks = ctx.String("dead-webhooks")
+	if deadWebhooks != DeadWebhooksWarn && deadWebhooks != DeadWebhooksIgnore && deadWebhooks != DeadWebhooksDelete {
+		return fmt.Errorf("invalid dead webhooks action [%s], must be one of warn|ignore|delete", deadWebhooks)
+	}
+	if !targetsClusterScope() {
+		// webhook configurations are cluster scoped
+		deadWebhooks = DeadWebhooksWarn
+	}
+	return nil
+}
+
+// setRunComponents returns the components the run removes, their namespaces
+// are rancher's and the namespaces of the components it keeps are protected.
+func setRunComponents(ctx *cli.Context, client *kubernetes.Clientset) ([]component, error) {
+	components, err := getComponents(ctx, client)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	clusterRoles = append(clusterRoles, staticClusterRoles...)
-	for _, clusterRole := range clusterRoles {
-		logrus.Infof("deleting cluster role [%s]..", clusterRole)
-		if err := deleteClusterRole(k8sClient, clusterRole); err != nil && !errors.IsNotFound(err) {
-			return err
+	removedComponents = components
+	for _, c := range components {
+		for _, namespace := range c.namespaces {
+			rancherCreatedNamespaces[namespace] = true
 		}
 	}
+	if snapshotKeepsBackup(ctx) {
+		logrus.Infof("keeping rancher %s, it stores the snapshot", backupComponent.name)
+		for _, namespace := range backupComponent.namespaces {
+			protectedNamespaces[namespace] = true
+		}
+	}
+	if !ctx.Bool("include-longhorn") {
+		for _, namespace := range longhornComponent.namespaces {
+			protectedNamespaces[namespace] = true
+		}
+	}
+	return components, nil
+}
 
-	clusterRoleBindings, err := getCattleClusterRoleBindingsList(k8sClient)
-	if err != nil {
-		return err
+// setRunKeptObjects returns the projects, clusters and users of rancher and
+// keeps the clusters and users of --keep-cluster and --keep-user, and the
+// admins unless --include-admin-users is set.
+func setRunKeptObjects(ctx *cli.Context, management *config.ManagementContext) ([]v3.Project, []v3.Cluster, []v3.User, error) {
+	var projects []v3.Project
+	var clusters []v3.Cluster
+	var users []v3.User
+	var err error
+	if servedGroups.Has(managementGroup) {
+		projects, err = getProjectList(management)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		clusters, err = getClusterList(management)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		users, err = getUserList(management)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	} else {
+		logrus.Infof("%s is not served, skipping projects, clusters and users", managementGroup)
+	}
+	for _, name := range ctx.StringSlice("keep-cluster") {
+		keepClusters[name] = true
+	}
+	protectKeptClusters(clusters, projects)
+	for _, name := range ctx.StringSlice("keep-user") {
+		keepUsers[name] = true
+	}
+	if !ctx.Bool("include-admin-users") && servedGroups.Has(managementGroup) {
+		admins, err := getAdminUsers(management)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		for _, name := range admins {
+			keepUsers[name] = true
+		}
+	}
+	for name := range keepUsers {
+		protectedNamespaces[name] = true
 	}
+	if servedGroups.Has(managementGroup) {
+		removedUsers = sets.NewString()
+		for _, user := range users {
+			if !keepUsers[user.Name] {
+				removedUsers.Insert(user.Name)
+				// rancher creates a namespace named after every user
+				rancherCreatedNamespaces[user.Name] = true
+			}
+		}
+	}
+	return projects, clusters, users, nil
+}
 
-	for _, clusterRoleBinding := range clusterRoleBindings {
-		logrus.Infof("deleting cluster role binding [%s]..", clusterRoleBinding)
-		if err := deleteClusterRoleBinding(k8sClient, clusterRoleBinding); err != nil && !errors.IsNotFound(err) {
-			return err
+// protectKeptClusters protects the namespaces of the kept clusters and of their
+// projects and collects their ids.
+func protectKeptClusters(clusters []v3.Cluster, projects []v3.Project) {
+	keptIDs = nil
+	found := map[string]bool{}
+	for _, cluster := range clusters {
+		if keepClusters[cluster.Name] {
+			found[cluster.Name] = true
+		}
+	}
+	for name := range keepClusters {
+		if !found[name] {
+			logrus.Warnf("cluster [%s] to keep does not exist", name)
+		}
+		protectedNamespaces[name] = true
+		keptIDs = append(keptIDs, name)
+	}
+	for _, project := range projects {
+		if keepClusters[project.Namespace] {
+			protectedNamespaces[project.Name] = true
+			keptIDs = append(keptIDs, project.Name)
+		}
+	}
+}
+
+// isKept reports whether the object named name belongs to a kept cluster or
+// project, rancher embeds their ids in the names of the rbac it creates. An id
+// only matches as a whole, delimited by the start or end of the name or by
+// one of idDelimiters, so c-abc doesn't keep c-abcde.
+func isKept(name string) bool {
+	for _, id := range keptIDs {
+		if containsID(name, id) {
+			return true
 		}
 	}
-	// final cleanup
-	logrus.Infof("removing rancher deployment namespace [%s]", cattleNamespace)
-	return deleteNamespace(k8sClient, cattleNamespace)
+	return false
 }
 
-func getClientSet(ctx *cli.Context) (*kubernetes.Clientset, error) {
-	config, _ := getRestConfig(ctx)
+// idDelimiters separate the ids rancher embeds in the names of its objects.
+const idDelimiters = "-:."
+
+func containsID(name, id string) bool {
+	if id == "" {
+		return false
+	}
+	for start := 0; start+len(id) <= len(name); {
+		i := strings.Index(name[start:], id)
+		if i < 0 {
+			return false
+		}
+		i += start
+		end := i + len(id)
+		if (i == 0 || strings.IndexByte(idDelimiters, name[i-1]) >= 0) &&
+			(end == len(name) || strings.IndexByte(idDelimiters, name[end]) >= 0) {
+			return true
+		}
+		start = i + 1
+	}
+	return false
+}
+
+// skipNamespace reports whether objects in namespace must be left alone,
+// cluster scoped objects have an empty namespace.
+func skipNamespace(namespace string) bool {
+	if protectedNamespaces[namespace] {
+		return true
+	}
+	return len(targetNamespaces) > 0 && !targetNamespaces[namespace]
+}
+
+// parseTargetNamespaces returns the namespaces of --target-namespaces.
+func parseTargetNamespaces(ctx *cli.Context) map[string]bool {
+	namespaces := map[string]bool{}
+	for _, namespace := range strings.Split(ctx.String("target-namespaces"), ",") {
+		if namespace = strings.TrimSpace(namespace); namespace != "" {
+			namespaces[namespace] = true
+		}
+	}
+	return namespaces
+}
+
+// targetsClusterScope reports whether cluster scoped objects are part of the
+// cleanup, they are not when it is limited by --target-namespaces.
+func targetsClusterScope() bool {
+	return len(targetNamespaces) == 0
+}
+
+func getClientSet(ctx *cli.Context, scope *requestScope) (*kubernetes.Clientset, error) {
+	config, _ := getRestConfig(ctx, scope)
 	// create the clientset
 	clientset, err := kubernetes.NewForConfig(config)
 	if err != nil {
@@ -164,18 +1373,67 @@ func getClientSet(ctx *cli.Context) (*kubernetes.Clientset, error) {
 	return clientset, nil
 }
 
-func getRestConfig(ctx *cli.Context) (*rest.Config, error) {
-	kubeconfig := ctx.String("kubeconfig")
-	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+// getRestConfig returns the config of the kubeconfig context of the run, its
+// requests are bound to scope, or runContext when scope is nil.
+func getRestConfig(ctx *cli.Context, scope *requestScope) (*rest.Config, error) {
+	// only the commands running against several contexts set kubeContext
+	context := kubeContext
+	if context == "" {
+		context = ctx.GlobalString("context")
+	}
+	config, err := loadRestConfig(ctx.GlobalString("kubeconfig"), context)
 	if err != nil {
 		return nil, err
 	}
+	if !inDownstreamContext {
+		if server := ctx.GlobalString("server"); server != "" {
+			config.Host = server
+		}
+		if path := ctx.GlobalString("certificate-authority"); path != "" {
+			ca, err := ioutil.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			config.TLSClientConfig.CAData = ca
+			config.TLSClientConfig.CAFile = ""
+			config.TLSClientConfig.Insecure = false
+		}
+	}
+	if ctx.GlobalBool("insecure-skip-tls-verify") {
+		if ctx.GlobalString("certificate-authority") != "" {
+			return nil, fmt.Errorf("--insecure-skip-tls-verify and --certificate-authority can't be used together")
+		}
+		logrus.Warnf("NOT VERIFYING the certificate of [%s], anyone in between can read the credentials and tamper with the cleanup", config.Host)
+		config.TLSClientConfig.CAData = nil
+		config.TLSClientConfig.CAFile = ""
+		config.TLSClientConfig.Insecure = true
+	}
+	if as := ctx.GlobalString("as"); as != "" {
+		config.Impersonate = rest.ImpersonationConfig{UserName: as, Groups: ctx.GlobalStringSlice("as-group")}
+	} else if len(ctx.GlobalStringSlice("as-group")) > 0 {
+		return nil, fmt.Errorf("--as-group needs --as")
+	}
+	if qps := ctx.GlobalFloat64("kube-api-qps"); qps > 0 {
+		config.QPS = float32(qps)
+	}
+	if burst := ctx.GlobalInt("kube-api-burst"); burst > 0 {
+		config.Burst = burst
+	}
+	if objectTimeout > 0 {
+		config.Timeout = objectTimeout
+	}
+	withRunContext(config, scope)
+	withAPIStats(config)
 	return config, nil
 }
 
 func getProjectList(mgmtCtx *config.ManagementContext) ([]v3.Project, error) {
 	projectList, err := mgmtCtx.Management.Projects("").List(v1.ListOptions{})
 	if err != nil {
+		// imported clusters have no management crds
+		if errors.IsNotFound(err) {
+			return nil, nil
+		}
 		return nil, err
 	}
 
@@ -185,15 +1443,43 @@ func getProjectList(mgmtCtx *config.ManagementContext) ([]v3.Project, error) {
 func getUserList(mgmtCtx *config.ManagementContext) ([]v3.User, error) {
 	userList, err := mgmtCtx.Management.Users("").List(v1.ListOptions{})
 	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil
+		}
 		return nil, err
 	}
 
 	return userList.Items, nil
 }
 
+// getAdminUsers returns the users bound to the admin global role.
+func getAdminUsers(mgmtCtx *config.ManagementContext) ([]string, error) {
+	grbList, err := mgmtCtx.Management.GlobalRoleBindings("").List(v1.ListOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return adminUsersOf(grbList.Items), nil
+}
+
+func adminUsersOf(grbs []v3.GlobalRoleBinding) []string {
+	admins := []string{}
+	for _, grb := range grbs {
+		if grb.GlobalRoleName == "admin" {
+			admins = append(admins, grb.UserName)
+		}
+	}
+	return admins
+}
+
 func getClusterList(mgmtCtx *config.ManagementContext) ([]v3.Cluster, error) {
 	clusterList, err := mgmtCtx.Management.Clusters("").List(v1.ListOptions{})
 	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil
+		}
 		return nil, err
 	}
 
@@ -201,81 +1487,415 @@ func getClusterList(mgmtCtx *config.ManagementContext) ([]v3.Cluster, error) {
 }
 
 func deleteProject(mgmtCtx *config.ManagementContext, project v3.Project) error {
-
-	return mgmtCtx.Management.Projects(project.Namespace).Delete(project.Name, &v1.DeleteOptions{
-		PropagationPolicy:  &deletePolicy,
-		GracePeriodSeconds: new(int64),
+	err := mgmtCtx.Management.Projects(project.Namespace).Delete(project.Name, getDeleteOptions())
+	if err := recordDelete(objectOf(managementAPIVersion, "Project", &project), err); err != nil {
+		return err
+	}
+	return waitDeleted("project", project.Name, func() error {
+		_, err := mgmtCtx.Management.Projects(project.Namespace).Get(project.Name, v1.GetOptions{})
+		return err
 	})
 }
 
 func deleteCluster(mgmtCtx *config.ManagementContext, cluster v3.Cluster) error {
-
-	return mgmtCtx.Management.Clusters("").Delete(cluster.Name, &v1.DeleteOptions{
-		PropagationPolicy:  &deletePolicy,
-		GracePeriodSeconds: new(int64),
+	err := mgmtCtx.Management.Clusters("").Delete(cluster.Name, getDeleteOptions())
+	if err := recordDelete(objectOf(managementAPIVersion, "Cluster", &cluster), err); err != nil {
+		return err
+	}
+	return waitDeleted("cluster", cluster.Name, func() error {
+		_, err := mgmtCtx.Management.Clusters("").Get(cluster.Name, v1.GetOptions{})
+		return err
 	})
 }
 
 func deleteUser(mgmtCtx *config.ManagementContext, user v3.User) error {
+	err := mgmtCtx.Management.Users("").Delete(user.Name, getDeleteOptions())
+	if err := recordDelete(objectOf(managementAPIVersion, "User", &user), err); err != nil {
+		return err
+	}
+	return waitDeleted("user", user.Name, func() error {
+		_, err := mgmtCtx.Management.Users("").Get(user.Name, v1.GetOptions{})
+		return err
+	})
+}
 
-	return mgmtCtx.Management.Users("").Delete(user.Name, &v1.DeleteOptions{
+// userPreferencesCleanup deletes the ui preferences kept in the namespace of
+// a user, there can be thousands of them so they go as a collection.
+func userPreferencesCleanup(mgmtCtx *config.ManagementContext, namespace string) error {
+	if skipNamespace(namespace) {
+		return nil
+	}
+	logrus.Infof("deleting preferences [%s]..", namespacedName(namespace, "*"))
+	err := mgmtCtx.Management.Preferences(namespace).DeleteCollection(getDeleteOptions(), v1.ListOptions{})
+	return recordDelete(selectedObjects(managementAPIVersion, "Preference", namespace, ""), err)
+}
+
+func getDeleteOptions() *v1.DeleteOptions {
+	options := &v1.DeleteOptions{
 		PropagationPolicy:  &deletePolicy,
-		GracePeriodSeconds: new(int64),
-	})
+		GracePeriodSeconds: &gracePeriod,
+	}
+	if gracePeriod < 0 {
+		// the default grace period of every object
+		options.GracePeriodSeconds = nil
+	}
+	return options
+}
+
+// namespaceSkipReason returns why the cleanup leaves the namespace name in
+// place, or an empty string when it deletes it.
+func namespaceSkipReason(name string) string {
+	switch {
+	case preserveWorkloads && !isRancherNamespace(name):
+		return "workloads are preserved"
+	case !includeProjectNamespaces && !isRancherCreatedNamespace(name):
+		return "not created by rancher"
+	case skipNamespace(name):
+		return "protected"
+	}
+	return ""
 }
 
 func deleteNamespace(client *kubernetes.Clientset, name string) error {
+	if reason := namespaceSkipReason(name); reason != "" {
+		logrus.Infof("keeping namespace [%s], %s", name, reason)
+		recordSkip(namedObject("v1", "Namespace", "", name), reason)
+		return nil
+	}
+	err := client.CoreV1().Namespaces().Delete(name, getDeleteOptions())
+	return recordDelete(namedObject("v1", "Namespace", "", name), err)
+}
 
-	return client.CoreV1().Namespaces().Delete(name, &v1.DeleteOptions{
-		PropagationPolicy:  &deletePolicy,
-		GracePeriodSeconds: new(int64),
-	})
+// pipelineNamespacePattern matches the namespaces legacy pipelines run in,
+// one per project.
+var pipelineNamespacePattern = regexp.MustCompile(`^p-[a-z0-9]+-pipeline$`)
+
+// pipelineNamespacesCleanup deletes the namespaces of legacy pipelines, they
+// exist in downstream clusters where no project is listed.
+func pipelineNamespacesCleanup(client *kubernetes.Clientset) error {
+	namespaces, err := getNamespacesList(client)
+	if err != nil {
+		return err
+	}
+	for _, namespace := range namespaces {
+		if !pipelineNamespacePattern.MatchString(namespace) {
+			continue
+		}
+		logrus.Infof("deleting pipeline namespace [%s]..", namespace)
+		if err := deleteNamespace(client, namespace); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// isRancherCreatedNamespace tells the namespaces rancher created for itself,
+// its clusters, projects and users from the ones users created.
+func isRancherCreatedNamespace(name string) bool {
+	return isRancherNamespace(name) || hasAnyPrefix(name, rancherNamespacePrefixes) || name == "local" || rancherCreatedNamespaces[name]
+}
+
+func isRancherNamespace(name string) bool {
+	return name == cattleNamespace || strings.HasPrefix(name, "cattle-")
 }
 
 func deleteClusterRole(client *kubernetes.Clientset, name string) error {
-	return client.RbacV1().ClusterRoles().Delete(name, &v1.DeleteOptions{
-		PropagationPolicy:  &deletePolicy,
-		GracePeriodSeconds: new(int64),
-	})
+	err := client.RbacV1().ClusterRoles().Delete(name, getDeleteOptions())
+	return recordDelete(namedObject(rbacAPIVersion, "ClusterRole", "", name), err)
 }
 
 func deleteClusterRoleBinding(client *kubernetes.Clientset, name string) error {
+	err := client.RbacV1().ClusterRoleBindings().Delete(name, getDeleteOptions())
+	return recordDelete(namedObject(rbacAPIVersion, "ClusterRoleBinding", "", name), err)
+}
 
-	return client.RbacV1().ClusterRoleBindings().Delete(name, &v1.DeleteOptions{
-		PropagationPolicy:  &deletePolicy,
-		GracePeriodSeconds: new(int64),
-	})
+func deleteSecret(client *kubernetes.Clientset, namespace, name string) error {
+	err := client.CoreV1().Secrets(namespace).Delete(name, getDeleteOptions())
+	return recordDelete(namedObject("v1", "Secret", namespace, name), err)
 }
 
-func getCattleClusterRoleBindingsList(client *kubernetes.Clientset) ([]string, error) {
-	crbList, err := client.RbacV1().ClusterRoleBindings().List(cattleListOptions)
+// scalingPoliciesCleanup deletes the horizontal pod autoscalers and pod
+// disruption budgets charts installed in the rancher namespaces, a budget left
+// behind can block node drains.
+func scalingPoliciesCleanup(client *kubernetes.Clientset) error {
+	errs := []error{}
+	hpas, err := client.AutoscalingV1().HorizontalPodAutoscalers("").List(v1.ListOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	if hpas != nil {
+		for _, hpa := range hpas.Items {
+			if !isRancherNamespace(hpa.Namespace) || skipNamespace(hpa.Namespace) {
+				continue
+			}
+			logrus.Infof("deleting horizontal pod autoscaler [%s/%s]..", hpa.Namespace, hpa.Name)
+			err := client.AutoscalingV1().HorizontalPodAutoscalers(hpa.Namespace).Delete(hpa.Name, getDeleteOptions())
+			if err = recordDelete(objectOf("autoscaling/v1", "HorizontalPodAutoscaler", &hpa), err); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	pdbs, err := client.PolicyV1beta1().PodDisruptionBudgets("").List(v1.ListOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	if pdbs != nil {
+		for _, pdb := range pdbs.Items {
+			if !isRancherNamespace(pdb.Namespace) || skipNamespace(pdb.Namespace) {
+				continue
+			}
+			logrus.Infof("deleting pod disruption budget [%s/%s]..", pdb.Namespace, pdb.Name)
+			err := client.PolicyV1beta1().PodDisruptionBudgets(pdb.Namespace).Delete(pdb.Name, getDeleteOptions())
+			if err = recordDelete(objectOf("policy/v1beta1", "PodDisruptionBudget", &pdb), err); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return cleanupErrors(errs)
+	}
+	return nil
+}
+
+// isCattleNetworkPolicy tells a network policy created by rancher's project
+// network isolation, like np-default and hn-nodes, by its cattle metadata.
+func isCattleNetworkPolicy(policy v1.Object) bool {
+	for key := range policy.GetLabels() {
+		if hasAnyPrefix(key, metadataPrefixes) {
+			return true
+		}
+	}
+	for key := range policy.GetAnnotations() {
+		if hasAnyPrefix(key, metadataPrefixes) {
+			return true
+		}
+	}
+	return false
+}
+
+// networkPoliciesCleanup deletes the project isolation network policies of
+// every namespace, they would keep restricting traffic once rancher is gone.
+func networkPoliciesCleanup(client *kubernetes.Clientset) error {
+	policies, err := client.NetworkingV1().NetworkPolicies("").List(v1.ListOptions{})
 	if err != nil {
-		return nil, err
+		return err
+	}
+	errs := []error{}
+	for _, policy := range policies.Items {
+		if !isCattleNetworkPolicy(&policy) || skipNamespace(policy.Namespace) {
+			continue
+		}
+		logrus.Infof("deleting network policy [%s/%s]..", policy.Namespace, policy.Name)
+		err := client.NetworkingV1().NetworkPolicies(policy.Namespace).Delete(policy.Name, getDeleteOptions())
+		if err = recordDelete(objectOf("networking.k8s.io/v1", "NetworkPolicy", &policy), err); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return cleanupErrors(errs)
+	}
+	return nil
+}
+
+// networkingCleanup deletes ingresses, services and endpoints in namespace
+// explicitly so load balancers and dns records are released by their
+// controllers instead of being orphaned by the namespace deletion.
+func networkingCleanup(client *kubernetes.Clientset, namespace string) error {
+	ingresses, err := client.ExtensionsV1beta1().Ingresses(namespace).List(v1.ListOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	if ingresses != nil {
+		for _, ingress := range ingresses.Items {
+			logrus.Infof("deleting ingress [%s/%s]..", namespace, ingress.Name)
+			err := client.ExtensionsV1beta1().Ingresses(namespace).Delete(ingress.Name, getDeleteOptions())
+			if err = recordDelete(objectOf("extensions/v1beta1", "Ingress", &ingress), err); err != nil {
+				return err
+			}
+		}
+	}
+	services, err := client.CoreV1().Services(namespace).List(v1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for _, service := range services.Items {
+		logrus.Infof("deleting service [%s/%s]..", namespace, service.Name)
+		err := client.CoreV1().Services(namespace).Delete(service.Name, getDeleteOptions())
+		if err = recordDelete(objectOf("v1", "Service", &service), err); err != nil {
+			return err
+		}
+	}
+	endpoints, err := client.CoreV1().Endpoints(namespace).List(v1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for _, endpoint := range endpoints.Items {
+		logrus.Infof("deleting endpoints [%s/%s]..", namespace, endpoint.Name)
+		err := client.CoreV1().Endpoints(namespace).Delete(endpoint.Name, getDeleteOptions())
+		if err = recordDelete(objectOf("v1", "Endpoints", &endpoint), err); err != nil {
+			return err
+		}
 	}
-	crbNames := []string{}
-	for _, crb := range crbList.Items {
-		crbNames = append(crbNames, crb.Name)
+	return nil
+}
+
+// clusterStateSecretsCleanup deletes the kubeconfig, certificate and cluster
+// state secrets rancher keeps for provisioned clusters, they are named after
+// the cluster id with a c- prefix.
+func clusterStateSecretsCleanup(client *kubernetes.Clientset, clusters []v3.Cluster) error {
+	for _, namespace := range []string{cattleNamespace, CattleGlobalDataNamespace} {
+		if skipNamespace(namespace) {
+			continue
+		}
+		secrets, err := client.CoreV1().Secrets(namespace).List(v1.ListOptions{})
+		if err != nil {
+			if errors.IsNotFound(err) {
+				continue
+			}
+			return err
+		}
+		for _, secret := range secrets.Items {
+			if !isClusterStateSecret(secret.Name, clusters) {
+				continue
+			}
+			logrus.Infof("deleting cluster secret [%s/%s]..", namespace, secret.Name)
+			if err := deleteSecret(client, namespace, secret.Name); err != nil && !errors.IsNotFound(err) {
+				return err
+			}
+		}
 	}
+	return nil
+}
 
-	return crbNames, nil
+// certificateSecretsCleanup deletes the serving certificates of rancher, its
+// dynamic listener and rancher-webhook so none of them are picked up again by
+// a reinstall. The ingress certificate and the private ca are deleted
+// explicitly rather than with the namespace so their removal is reported.
+func certificateSecretsCleanup(client *kubernetes.Clientset) error {
+	secrets := map[string][]string{
+		cattleNamespace: {
+			"cattle-webhook-tls",
+			"cattle-webhook-ca",
+			"serving-cert",
+			"tls-ca",
+			"tls-ca-additional",
+			"tls-rancher",
+			"tls-rancher-internal",
+			"tls-rancher-internal-ca",
+			"tls-rancher-ingress",
+		},
+		v1.NamespaceSystem: {
+			"cattle-webhook-tls",
+			"dynamiclistener-cert",
+		},
+	}
+	for namespace, names := range secrets {
+		if skipNamespace(namespace) {
+			continue
+		}
+		for _, name := range names {
+			err := deleteSecret(client, namespace, name)
+			if errors.IsNotFound(err) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			logrus.Infof("deleted certificate secret [%s/%s]", namespace, name)
+		}
+	}
+	return nil
 }
 
-func getCattleClusterRolesList(client *kubernetes.Clientset) ([]string, error) {
-	crList, err := client.RbacV1().ClusterRoles().List(cattleListOptions)
+// clusterCredentialsCleanup deletes the secrets in the namespace of a
+// downstream cluster one by one, the service account tokens and cluster
+// connect credentials in there grant cluster admin on the downstream cluster
+// so each of them is reported rather than left to the namespace deletion.
+func clusterCredentialsCleanup(client *kubernetes.Clientset, namespace string) error {
+	if skipNamespace(namespace) {
+		return nil
+	}
+	secrets, err := client.CoreV1().Secrets(namespace).List(v1.ListOptions{})
 	if err != nil {
-		return nil, err
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
 	}
-	crNames := []string{}
-	for _, cr := range crList.Items {
-		crNames = append(crNames, cr.Name)
+	for _, secret := range secrets.Items {
+		logrus.Infof("deleting cluster credential [%s/%s]..", namespace, secret.Name)
+		err := client.CoreV1().Secrets(namespace).Delete(secret.Name, getDeleteOptions())
+		if err = recordDelete(objectOf("v1", "Secret", &secret), err); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clusterRegistrationTokensCleanup deletes the registration tokens of a
+// downstream cluster one by one, they hold the import manifest url and the
+// credentials to join the cluster so each of them is reported.
+func clusterRegistrationTokensCleanup(mgmtCtx *config.ManagementContext, namespace string) error {
+	if skipNamespace(namespace) {
+		return nil
+	}
+	tokens, err := mgmtCtx.Management.ClusterRegistrationTokens(namespace).List(v1.ListOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	for _, token := range tokens.Items {
+		logrus.Infof("deleting cluster registration token [%s/%s]..", namespace, token.Name)
+		err := mgmtCtx.Management.ClusterRegistrationTokens(namespace).Delete(token.Name, getDeleteOptions())
+		if err = recordCredentialDelete(objectOf(managementAPIVersion, "ClusterRegistrationToken", &token), err); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isClusterStateSecret(name string, clusters []v3.Cluster) bool {
+	if !strings.HasPrefix(name, "c-") {
+		return false
+	}
+	for _, cluster := range clusters {
+		if strings.HasPrefix(name, cluster.Name) ||
+			strings.HasPrefix(strings.TrimPrefix(name, "c-"), cluster.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// cattleClusterRBACCleanup deletes the cattle cluster roles and bindings, the
+// ones of kept clusters are left in place.
+func cattleClusterRBACCleanup(pool dynamic.ClientPool) error {
+	if err := selectedResourcesCleanup(pool, rbacGroupVersion, &v1.APIResource{Name: "clusterrolebindings", Kind: "ClusterRoleBinding"}, cattleListOptions); err != nil {
+		return err
+	}
+	return selectedResourcesCleanup(pool, rbacGroupVersion, &v1.APIResource{Name: "clusterroles", Kind: "ClusterRole"}, cattleListOptions)
+}
+
+// namespacedRBACCleanup deletes the cattle roles and role bindings of every
+// namespace.
+func namespacedRBACCleanup(pool dynamic.ClientPool) error {
+	if err := selectedResourcesCleanup(pool, rbacGroupVersion, &v1.APIResource{Name: "rolebindings", Kind: "RoleBinding", Namespaced: true}, cattleListOptions); err != nil {
+		return err
 	}
-	return crNames, nil
+	return selectedResourcesCleanup(pool, rbacGroupVersion, &v1.APIResource{Name: "roles", Kind: "Role", Namespaced: true}, cattleListOptions)
 }
 
+// cleanupFinalizers returns finalizers without those matching one of
+// finalizerPatterns.
 func cleanupFinalizers(finalizers []string) []string {
+	if !stripFinalizers() {
+		return finalizers
+	}
 	updatedFinalizers := []string{}
 	for _, f := range finalizers {
-		if strings.Contains(f, CattleControllerName) {
+		if isCattleFinalizer(f) {
 			continue
 		}
 		updatedFinalizers = append(updatedFinalizers, f)
@@ -283,9 +1903,28 @@ func cleanupFinalizers(finalizers []string) []string {
 	return updatedFinalizers
 }
 
+func isCattleFinalizer(finalizer string) bool {
+	for _, re := range finalizerPatterns {
+		if re.MatchString(finalizer) {
+			return true
+		}
+	}
+	return false
+}
+
+func compileFinalizerPatterns(patterns []string) []*regexp.Regexp {
+	compiled := []*regexp.Regexp{}
+	for _, pattern := range patterns {
+		compiled = append(compiled, regexp.MustCompile(pattern))
+	}
+	return compiled
+}
+
+// cleanupAnnotationsLabels deletes the keys starting with one of
+// metadataPrefixes from m.
 func cleanupAnnotationsLabels(m map[string]string) map[string]string {
 	for k := range m {
-		if strings.Contains(k, CattleLabelBase) {
+		if hasAnyPrefix(k, metadataPrefixes) {
 			delete(m, k)
 		}
 	}
@@ -304,36 +1943,119 @@ func getNamespacesList(client *kubernetes.Clientset) ([]string, error) {
 	return nsNames, nil
 }
 
-func secretsCleanup(client *kubernetes.Clientset) error {
-	// cleanup finalizers..
-	secrets, err := client.CoreV1().Secrets("").List(v1.ListOptions{})
+// cleanupObjectMeta strips cattle finalizers, annotations and labels from obj
+// and reports whether anything was changed.
+func cleanupObjectMeta(obj v1.Object) bool {
+	finalizersCount := len(obj.GetFinalizers())
+	annotationsCount := len(obj.GetAnnotations())
+	labelsCount := len(obj.GetLabels())
+	obj.SetFinalizers(cleanupFinalizers(obj.GetFinalizers()))
+	obj.SetAnnotations(cleanupAnnotationsLabels(obj.GetAnnotations()))
+	obj.SetLabels(cleanupAnnotationsLabels(obj.GetLabels()))
+	return finalizersCount != len(obj.GetFinalizers()) ||
+		annotationsCount != len(obj.GetAnnotations()) ||
+		labelsCount != len(obj.GetLabels())
+}
+
+// dataResources are the secrets and configmaps rancher stamped cattle
+// finalizers, annotations and labels on.
+var dataResources = []string{"secrets", "configmaps"}
+
+func dataResourcesCleanup(client *kubernetes.Clientset) error {
+	errs := []error{}
+	for _, resource := range dataResources {
+		items, err := listObjectMetadata(client.CoreV1().RESTClient(), resource)
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			if skipNamespace(item.Namespace) || !cleanupObjectMeta(item) {
+				continue
+			}
+			if err := dataResourceCleanup(client, resource, item.Namespace, item.Name); err != nil && !errors.IsNotFound(err) {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return cleanupErrors(errs)
+	}
+	return nil
+}
+
+func dataResourceCleanup(client *kubernetes.Clientset, resource, namespace, name string) error {
+	core := client.CoreV1()
+	switch resource {
+	case "secrets":
+		secret, err := core.Secrets(namespace).Get(name, v1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		cleanupObjectMeta(secret)
+		_, err = core.Secrets(namespace).Update(secret)
+		if err = recordUpdate(objectOf("v1", "Secret", secret), err); err != nil {
+			return err
+		}
+	case "configmaps":
+		configMap, err := core.ConfigMaps(namespace).Get(name, v1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		cleanupObjectMeta(configMap)
+		_, err = core.ConfigMaps(namespace).Update(configMap)
+		if err = recordUpdate(objectOf("v1", "ConfigMap", configMap), err); err != nil {
+			return err
+		}
+	}
+	logrus.Infof("cleaned %s %s/%s", strings.TrimSuffix(resource, "s"), namespace, name)
+	return nil
+}
+
+// persistentVolumesCleanup only strips finalizers owned by cattle controllers,
+// kubernetes.io/pv-protection and friends are left in place.
+func persistentVolumesCleanup(client *kubernetes.Clientset) error {
+	pvList, err := client.CoreV1().PersistentVolumes().List(v1.ListOptions{})
 	if err != nil {
 		return err
 	}
 	errs := []error{}
-	for _, secret := range secrets.Items {
-		if len(secret.Finalizers) == 0 {
+	for _, pv := range pvList.Items {
+		if cleanupObjectMeta(&pv) {
+			_, err := client.CoreV1().PersistentVolumes().Update(&pv)
+			if err = recordUpdate(objectOf("v1", "PersistentVolume", &pv), err); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			logrus.Infof("cleaned persistent volume %s", pv.Name)
+		}
+	}
+	if len(errs) > 0 {
+		return cleanupErrors(errs)
+	}
+	return nil
+}
+
+func persistentVolumeClaimsCleanup(client *kubernetes.Clientset) error {
+	pvcList, err := client.CoreV1().PersistentVolumeClaims("").List(sweepListOptions)
+	if err != nil {
+		return err
+	}
+	errs := []error{}
+	for _, pvc := range pvcList.Items {
+		if skipNamespace(pvc.Namespace) {
 			continue
 		}
-		finalizers := cleanupFinalizers(secret.Finalizers)
-		annotations := cleanupAnnotationsLabels(secret.Annotations)
-		labels := cleanupAnnotationsLabels(secret.Labels)
-		if len(finalizers) != len(secret.Finalizers) ||
-			len(annotations) != len(secret.Annotations) ||
-			len(labels) != len(secret.Labels) {
-			secret.Finalizers = finalizers
-			secret.Annotations = annotations
-			secret.Labels = labels
-			_, err := client.CoreV1().Secrets(secret.Namespace).Update(&secret)
-			if err != nil {
-				logrus.Infof("%v", err)
+		if cleanupObjectMeta(&pvc) {
+			_, err := client.CoreV1().PersistentVolumeClaims(pvc.Namespace).Update(&pvc)
+			if err = recordUpdate(objectOf("v1", "PersistentVolumeClaim", &pvc), err); err != nil {
 				errs = append(errs, err)
+				continue
 			}
-			logrus.Infof("cleaned secret %s/%s", secret.Namespace, secret.Name)
+			logrus.Infof("cleaned persistent volume claim %s/%s", pvc.Namespace, pvc.Name)
 		}
 	}
 	if len(errs) > 0 {
-		return fmt.Errorf("%v", errs)
+		return cleanupErrors(errs)
 	}
 	return nil
 }
@@ -345,23 +2067,21 @@ func namespacesCleanup(client *kubernetes.Clientset) error {
 	}
 	errs := []error{}
 	for _, ns := range nsList.Items {
-		finalizers := cleanupFinalizers(ns.Finalizers)
-		annotations := cleanupAnnotationsLabels(ns.Annotations)
-		labels := cleanupAnnotationsLabels(ns.Labels)
-		if len(finalizers) != len(ns.Finalizers) ||
-			len(annotations) != len(ns.Annotations) ||
-			len(labels) != len(ns.Labels) {
-			ns.Finalizers = finalizers
-			ns.Annotations = annotations
-			ns.Labels = labels
-			if _, err = client.CoreV1().Namespaces().Update(&ns); err != nil {
+		if skipNamespace(ns.Name) {
+			recordSkip(objectOf("v1", "Namespace", &ns), "protected")
+			continue
+		}
+		if cleanupObjectMeta(&ns) {
+			_, err = client.CoreV1().Namespaces().Update(&ns)
+			if err = recordUpdate(objectOf("v1", "Namespace", &ns), err); err != nil {
 				errs = append(errs, err)
+				continue
 			}
 			logrus.Infof("cleaned namespace %s", ns.Name)
 		}
 	}
 	if len(errs) > 0 {
-		return fmt.Errorf("%v", errs)
+		return cleanupErrors(errs)
 	}
 	return nil
 }
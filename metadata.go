@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/apis/meta/v1beta1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// partialObjectMetadataAccept asks the api server to only return the metadata
+// of listed objects, servers that don't support it fall back to full objects
+// which decode into the same list type.
+const partialObjectMetadataAccept = "application/json;as=PartialObjectMetadataList;g=meta.k8s.io;v=v1," +
+	"application/json;as=PartialObjectMetadataList;g=meta.k8s.io;v=v1beta1," +
+	"application/json"
+
+// sweepListOptions constrain the lists of the sweeps over namespaced objects,
+// see --field-selector.
+var sweepListOptions = v1.ListOptions{}
+
+// listObjectMetadata lists the metadata of all objects of resource across all
+// namespaces matching sweepListOptions.
+func listObjectMetadata(client rest.Interface, resource string) ([]*v1beta1.PartialObjectMetadata, error) {
+	request := client.Get().
+		Resource(resource).
+		SetHeader("Accept", partialObjectMetadataAccept)
+	if sweepListOptions.FieldSelector != "" {
+		request = request.Param("fieldSelector", sweepListOptions.FieldSelector)
+	}
+	data, err := request.DoRaw()
+	if err != nil {
+		return nil, err
+	}
+	list := &v1beta1.PartialObjectMetadataList{}
+	if err := json.Unmarshal(data, list); err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+// metadataSkippedResources are either cleaned up by their own pass or never
+// carry cattle metadata.
+var metadataSkippedResources = sets.NewString("secrets", "configmaps", "persistentvolumeclaims", "events")
+
+// namespacedResourcesCleanup strips cattle finalizers, annotations, labels and
+// orphaned cattle owner references from objects of every namespaced kind
+// served by the cluster, like the workloads created through the rancher ui
+// and the load balancer services and ingresses rancher annotates.
+func namespacedResourcesCleanup(client *kubernetes.Clientset, pool dynamic.ClientPool) error {
+	owners, err := newOwnerChecker(client, pool)
+	if err != nil {
+		return err
+	}
+	resourceLists, err := client.Discovery().ServerPreferredNamespacedResources()
+	if err != nil {
+		if !discovery.IsGroupDiscoveryFailedError(err) {
+			return err
+		}
+		logrus.Warnf("skipping unavailable api groups: %v", err)
+	}
+	resourceLists = discovery.FilteredBy(discovery.SupportsAllVerbs{Verbs: []string{"list", "update"}}, resourceLists)
+	errs := []error{}
+	for _, resourceList := range resourceLists {
+		gv, err := schema.ParseGroupVersion(resourceList.GroupVersion)
+		if err != nil {
+			return err
+		}
+		dynamicClient, err := pool.ClientForGroupVersionKind(gv.WithKind(""))
+		if err != nil {
+			return err
+		}
+		for i := range resourceList.APIResources {
+			resource := &resourceList.APIResources[i]
+			if metadataSkippedResources.Has(resource.Name) {
+				continue
+			}
+			obj, err := dynamicClient.Resource(resource, "").List(sweepListOptions)
+			if err != nil {
+				if !errors.IsNotFound(err) && !errors.IsMethodNotSupported(err) {
+					errs = append(errs, err)
+				}
+				continue
+			}
+			list, ok := obj.(*unstructured.UnstructuredList)
+			if !ok {
+				continue
+			}
+			for _, item := range list.Items {
+				if skipNamespace(item.GetNamespace()) {
+					continue
+				}
+				metaChanged := cleanupObjectMeta(&item)
+				ownersChanged := cleanupOwnerReferences(&item, owners)
+				if !metaChanged && !ownersChanged {
+					continue
+				}
+				_, err := dynamicClient.Resource(resource, item.GetNamespace()).Update(&item)
+				if err = recordUpdate(objectOf(resourceList.GroupVersion, resource.Kind, &item), err); err != nil {
+					errs = append(errs, err)
+					continue
+				}
+				logrus.Infof("cleaned %s %s/%s", resource.Kind, item.GetNamespace(), item.GetName())
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return cleanupErrors(errs)
+	}
+	return nil
+}
+
+// kubeSystemNamespace holds objects rancher annotates and takes ownership of,
+// like the kontainer-engine configmaps and the cattle-controllers lease.
+const kubeSystemNamespace = "kube-system"
+
+// kubeSystemCleanup strips cattle metadata and every cattle owner reference
+// from the objects in kube-system, owners still around would otherwise take
+// them along once they are deleted. Nothing in kube-system is deleted.
+func kubeSystemCleanup(client *kubernetes.Clientset, pool dynamic.ClientPool) error {
+	if skipNamespace(kubeSystemNamespace) {
+		return nil
+	}
+	resourceLists, err := client.Discovery().ServerPreferredNamespacedResources()
+	if err != nil {
+		if !discovery.IsGroupDiscoveryFailedError(err) {
+			return err
+		}
+		logrus.Warnf("skipping unavailable api groups: %v", err)
+	}
+	resourceLists = discovery.FilteredBy(discovery.SupportsAllVerbs{Verbs: []string{"list", "update"}}, resourceLists)
+	errs := []error{}
+	for _, resourceList := range resourceLists {
+		gv, err := schema.ParseGroupVersion(resourceList.GroupVersion)
+		if err != nil {
+			return err
+		}
+		dynamicClient, err := pool.ClientForGroupVersionKind(gv.WithKind(""))
+		if err != nil {
+			return err
+		}
+		for i := range resourceList.APIResources {
+			resource := &resourceList.APIResources[i]
+			if resource.Name == "events" {
+				continue
+			}
+			obj, err := dynamicClient.Resource(resource, kubeSystemNamespace).List(sweepListOptions)
+			if err != nil {
+				if !errors.IsNotFound(err) && !errors.IsMethodNotSupported(err) {
+					errs = append(errs, err)
+				}
+				continue
+			}
+			list, ok := obj.(*unstructured.UnstructuredList)
+			if !ok {
+				continue
+			}
+			for _, item := range list.Items {
+				metaChanged := cleanupObjectMeta(&item)
+				ownersChanged := removeCattleOwnerReferences(&item)
+				if !metaChanged && !ownersChanged {
+					continue
+				}
+				_, err := dynamicClient.Resource(resource, kubeSystemNamespace).Update(&item)
+				if err = recordUpdate(objectOf(resourceList.GroupVersion, resource.Kind, &item), err); err != nil {
+					errs = append(errs, err)
+					continue
+				}
+				logrus.Infof("cleaned %s %s/%s", resource.Kind, kubeSystemNamespace, item.GetName())
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return cleanupErrors(errs)
+	}
+	return nil
+}
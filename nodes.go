@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"github.com/rancher/types/config"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// nodeCleanupScript follows the documented steps for removing kubernetes
+// components from rke nodes.
+const nodeCleanupScript = `set -x
+docker rm -f $(docker ps -qa)
+docker volume rm $(docker volume ls -q)
+for mount in $(mount | grep tmpfs | grep '/var/lib/kubelet' | awk '{ print $3 }') /var/lib/kubelet /var/lib/rancher; do
+  umount $mount
+done
+rm -rf /etc/ceph \
+  /etc/cni \
+  /etc/kubernetes \
+  /opt/cni \
+  /opt/rke \
+  /run/secrets/kubernetes.io \
+  /run/calico \
+  /run/flannel \
+  /var/lib/calico \
+  /var/lib/etcd \
+  /var/lib/cni \
+  /var/lib/kubelet \
+  /var/lib/rancher/rke/log \
+  /var/log/containers \
+  /var/log/kube-audit \
+  /var/log/pods \
+  /var/run/calico
+for link in flannel.1 cni0 tunl0 weave vxlan.calico; do
+  ip link delete $link
+done
+for link in $(ip -o link show | awk -F': ' '{ print $2 }' | grep -E '^(cali|veth)' | cut -d@ -f1); do
+  ip link delete $link
+done
+iptables -F -t nat
+iptables -X -t nat
+iptables -F -t mangle
+iptables -X -t mangle
+iptables -F
+iptables -X
+exit 0
+`
+
+func doCleanupNodes(ctx *cli.Context) error {
+	if ctx.String("ssh-key") == "" {
+		return fmt.Errorf("--ssh-key is required")
+	}
+	restConfig, err := getRestConfig(ctx, nil)
+	if err != nil {
+		return err
+	}
+	management, err := config.NewManagementContext(*restConfig)
+	if err != nil {
+		return err
+	}
+	clusters, err := getClusterList(management)
+	if err != nil {
+		return err
+	}
+	selected := sets.NewString(ctx.StringSlice("cluster")...)
+	nodes := []v3.RKEConfigNode{}
+	for _, cluster := range clusters {
+		if selected.Len() > 0 && !selected.Has(cluster.Name) {
+			continue
+		}
+		rkeConfig := cluster.Status.AppliedSpec.RancherKubernetesEngineConfig
+		if rkeConfig == nil {
+			logrus.Infof("skipping cluster [%s], it was not provisioned by rke", cluster.Name)
+			continue
+		}
+		nodes = append(nodes, rkeConfig.Nodes...)
+	}
+	if len(nodes) == 0 {
+		logrus.Infof("no rke nodes found")
+		return nil
+	}
+	if !ctx.Bool("yes") {
+		addresses := []string{}
+		for _, node := range nodes {
+			addresses = append(addresses, node.Address)
+		}
+		ok, err := confirm(fmt.Sprintf("remove all containers, kubernetes data and network configuration from %s?", strings.Join(addresses, ", ")))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+	}
+	errs := []error{}
+	for _, node := range nodes {
+		logrus.Infof("cleaning node [%s]..", node.Address)
+		if err := cleanupNode(ctx, node); err != nil {
+			logrus.Errorf("failed to clean node [%s]: %v", node.Address, err)
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return cleanupErrors(errs)
+	}
+	return nil
+}
+
+func cleanupNode(ctx *cli.Context, node v3.RKEConfigNode) error {
+	user := ctx.String("ssh-user")
+	if user == "" {
+		user = node.User
+	}
+	port := node.Port
+	if port == "" {
+		port = "22"
+	}
+	cmd := exec.Command("ssh",
+		"-i", ctx.String("ssh-key"),
+		"-p", port,
+		"-o", "BatchMode=yes",
+		"-o", "StrictHostKeyChecking="+ctx.String("ssh-strict-host-key-checking"),
+		fmt.Sprintf("%s@%s", user, node.Address),
+		"sudo sh -s")
+	cmd.Stdin = strings.NewReader(nodeCleanupScript)
+	out, err := cmd.CombinedOutput()
+	logrus.Debugf("%s", out)
+	if err != nil {
+		return fmt.Errorf("%s: %v: %s", node.Address, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
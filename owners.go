@@ -0,0 +1,126 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+// ownerChecker looks up whether the cattle owners referenced by objects still
+// exist, results are cached since many objects share the same owner.
+type ownerChecker struct {
+	pool      dynamic.ClientPool
+	resources map[schema.GroupVersionKind]*v1.APIResource
+	exists    map[string]bool
+}
+
+func newOwnerChecker(client *kubernetes.Clientset, pool dynamic.ClientPool) (*ownerChecker, error) {
+	resourceLists, err := client.Discovery().ServerPreferredResources()
+	if err != nil && !discovery.IsGroupDiscoveryFailedError(err) {
+		return nil, err
+	}
+	checker := &ownerChecker{
+		pool:      pool,
+		resources: map[schema.GroupVersionKind]*v1.APIResource{},
+		exists:    map[string]bool{},
+	}
+	for _, resourceList := range resourceLists {
+		gv, err := schema.ParseGroupVersion(resourceList.GroupVersion)
+		if err != nil {
+			return nil, err
+		}
+		if !isCattleGroup(gv.Group) {
+			continue
+		}
+		for i := range resourceList.APIResources {
+			resource := &resourceList.APIResources[i]
+			checker.resources[gv.WithKind(resource.Kind)] = resource
+		}
+	}
+	return checker, nil
+}
+
+// ownerExists reports whether the owner referenced by ref exists, owners of
+// kinds that are no longer served are considered gone.
+func (o *ownerChecker) ownerExists(namespace string, ref v1.OwnerReference) (bool, error) {
+	gv, err := schema.ParseGroupVersion(ref.APIVersion)
+	if err != nil {
+		return false, err
+	}
+	gvk := gv.WithKind(ref.Kind)
+	resource, ok := o.resources[gvk]
+	if !ok {
+		return false, nil
+	}
+	if !resource.Namespaced {
+		namespace = ""
+	}
+	key := gvk.String() + "/" + namespacedName(namespace, ref.Name)
+	if exists, ok := o.exists[key]; ok {
+		return exists, nil
+	}
+	dynamicClient, err := o.pool.ClientForGroupVersionKind(gvk)
+	if err != nil {
+		return false, err
+	}
+	owner, err := dynamicClient.Resource(resource, namespace).Get(ref.Name, v1.GetOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return false, err
+	}
+	exists := err == nil && owner.GetUID() == ref.UID
+	o.exists[key] = exists
+	return exists, nil
+}
+
+// cleanupOwnerReferences removes references to cattle owners that no longer
+// exist from obj and reports whether anything was changed.
+func cleanupOwnerReferences(obj v1.Object, owners *ownerChecker) bool {
+	refs := []v1.OwnerReference{}
+	for _, ref := range obj.GetOwnerReferences() {
+		gv, err := schema.ParseGroupVersion(ref.APIVersion)
+		if err != nil || !isCattleGroup(gv.Group) {
+			refs = append(refs, ref)
+			continue
+		}
+		exists, err := owners.ownerExists(obj.GetNamespace(), ref)
+		if err != nil {
+			logrus.Warnf("failed to look up owner %s [%s] of %s: %v", ref.Kind, ref.Name, namespacedName(obj.GetNamespace(), obj.GetName()), err)
+			refs = append(refs, ref)
+			continue
+		}
+		if exists {
+			refs = append(refs, ref)
+		}
+	}
+	if len(refs) == len(obj.GetOwnerReferences()) {
+		return false
+	}
+	obj.SetOwnerReferences(refs)
+	return true
+}
+
+// removeCattleOwnerReferences removes every reference to a cattle owner from
+// obj, existing or not, and reports whether anything was changed.
+func removeCattleOwnerReferences(obj v1.Object) bool {
+	refs := []v1.OwnerReference{}
+	for _, ref := range obj.GetOwnerReferences() {
+		if gv, err := schema.ParseGroupVersion(ref.APIVersion); err != nil || !isCattleGroup(gv.Group) {
+			refs = append(refs, ref)
+		}
+	}
+	if len(refs) == len(obj.GetOwnerReferences()) {
+		return false
+	}
+	obj.SetOwnerReferences(refs)
+	return true
+}
+
+func isCattleGroup(group string) bool {
+	return strings.HasSuffix(group, "."+CattleLabelBase)
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"github.com/rancher/types/config"
+	"github.com/urfave/cli"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+const projectIDAnnotation = "field.cattle.io/projectId"
+
+// doPlan prints what the cleanup would remove without changing anything:
+// every cluster with its projects and their namespaces, and every user with
+// the rbac bindings referencing it.
+func doPlan(ctx *cli.Context) error {
+	output := ctx.String("output")
+	if output != "text" && output != "script" {
+		return fmt.Errorf("invalid output [%s], must be one of text|script", output)
+	}
+	// the plan filters like the cleanup does
+	if err := setRunScope(ctx); err != nil {
+		return err
+	}
+	if dir := ctx.String("from-dump"); dir != "" {
+		if output != "text" {
+			return fmt.Errorf("--from-dump only supports the text output")
+		}
+		return doPlanFromDump(ctx, dir)
+	}
+	restConfig, err := getRestConfig(ctx, nil)
+	if err != nil {
+		return err
+	}
+	management, err := config.NewManagementContext(*restConfig)
+	if err != nil {
+		return err
+	}
+	k8sClient, err := getClientSet(ctx, nil)
+	if err != nil {
+		return err
+	}
+	servedGroups, err = getServedGroups(k8sClient)
+	if err != nil {
+		return err
+	}
+	if !servedGroups.Has(managementGroup) && output == "text" {
+		fmt.Printf("%s is not served, no clusters, projects or users to remove\n", managementGroup)
+		return nil
+	}
+	components, err := setRunComponents(ctx, k8sClient)
+	if err != nil {
+		return err
+	}
+	projects, clusters, users, err := setRunKeptObjects(ctx, management)
+	if err != nil {
+		return err
+	}
+	install, err := detectInstall(k8sClient)
+	if err != nil {
+		return err
+	}
+
+	dynamicClientPool, err := newClientPool(restConfig)
+	if err != nil {
+		return err
+	}
+	chartCRDs := []chartCRD{}
+	if ctx.Bool("include-chart-crds") {
+		chartCRDs, err = getChartCRDs(management.APIExtClient, dynamicClientPool)
+		if err != nil {
+			return err
+		}
+	}
+
+	projectNamespaces, err := getProjectNamespaces(k8sClient)
+	if err != nil {
+		return err
+	}
+	if output == "script" {
+		return printPlanScript(os.Stdout, management.APIExtClient, dynamicClientPool, install, components, chartCRDs, clusters, projects, users, projectNamespaces)
+	}
+	bindings, err := getUserBindings(k8sClient)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("install: %s\n", describeInstall(install))
+	printPlan(os.Stdout, clusters, projects, users, keepClusters, keepUsers, projectNamespaces, bindings)
+	if ctx.Bool("include-chart-crds") {
+		printChartCRDs(os.Stdout, chartCRDs)
+	}
+	return nil
+}
+
+// getPlanKept returns the clusters and users the plan keeps, admins are kept
+// on top of --keep-user.
+func getPlanKept(ctx *cli.Context, admins []string) (map[string]bool, map[string]bool) {
+	keptClusters := map[string]bool{}
+	for _, name := range ctx.StringSlice("keep-cluster") {
+		keptClusters[name] = true
+	}
+	keptUsers := map[string]bool{}
+	for _, name := range append(ctx.StringSlice("keep-user"), admins...) {
+		keptUsers[name] = true
+	}
+	return keptClusters, keptUsers
+}
+
+func printPlan(w io.Writer, clusters []v3.Cluster, projects []v3.Project, users []v3.User, keptClusters, keptUsers map[string]bool,
+	projectNamespaces, bindings map[string][]string) {
+	fmt.Fprintln(w, "clusters:")
+	for _, cluster := range clusters {
+		fmt.Fprintf(w, "  %s %q %s%s\n", cluster.Name, cluster.Spec.DisplayName, clusterOrigin(cluster), keptMark(keptClusters[cluster.Name]))
+		for _, project := range projects {
+			if project.Namespace != cluster.Name {
+				continue
+			}
+			fmt.Fprintf(w, "    project %s %q%s\n", project.Name, project.Spec.DisplayName, keptMark(keptClusters[cluster.Name]))
+			for _, namespace := range projectNamespaces[cluster.Name+":"+project.Name] {
+				fmt.Fprintf(w, "      namespace %s%s\n", namespace, keptMark(keptClusters[cluster.Name] || namespaceSkipReason(namespace) != ""))
+			}
+		}
+	}
+
+	fmt.Fprintln(w, "users:")
+	for _, user := range users {
+		fmt.Fprintf(w, "  %s %q%s\n", user.Name, user.Username, keptMark(keptUsers[user.Name]))
+		for _, binding := range bindings[user.Name] {
+			fmt.Fprintf(w, "    %s\n", binding)
+		}
+	}
+}
+
+// clusterOrigin tells provisioned clusters, whose nodes rancher owns, from
+// imported ones.
+func clusterOrigin(cluster v3.Cluster) string {
+	switch {
+	case cluster.Status.Driver == v3.ClusterDriverLocal:
+		return "(local)"
+	case cluster.Status.Driver == v3.ClusterDriverImported || cluster.Spec.ImportedConfig != nil:
+		return "(imported)"
+	case cluster.Status.Driver == "":
+		return "(unknown)"
+	}
+	return "(provisioned, " + cluster.Status.Driver + ")"
+}
+
+func keptMark(kept bool) string {
+	if kept {
+		return " [kept]"
+	}
+	return ""
+}
+
+// getProjectNamespaces returns the namespaces of every project keyed by
+// "<cluster>:<project>".
+func getProjectNamespaces(client *kubernetes.Clientset) (map[string][]string, error) {
+	nsList, err := client.CoreV1().Namespaces().List(v1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return projectNamespacesOf(nsList.Items), nil
+}
+
+func projectNamespacesOf(nsList []corev1.Namespace) map[string][]string {
+	namespaces := map[string][]string{}
+	for _, ns := range nsList {
+		if projectID := ns.Annotations[projectIDAnnotation]; projectID != "" {
+			namespaces[projectID] = append(namespaces[projectID], ns.Name)
+		}
+	}
+	return namespaces
+}
+
+// getUserBindings returns the cluster role bindings and role bindings that
+// have a user as subject, keyed by user.
+func getUserBindings(client *kubernetes.Clientset) (map[string][]string, error) {
+	crbList, err := client.RbacV1().ClusterRoleBindings().List(v1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	rbList, err := client.RbacV1().RoleBindings("").List(v1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return userBindingsOf(crbList.Items, rbList.Items), nil
+}
+
+func userBindingsOf(crbs []rbacv1.ClusterRoleBinding, rbs []rbacv1.RoleBinding) map[string][]string {
+	bindings := map[string][]string{}
+	for _, crb := range crbs {
+		for _, user := range bindingUsers(crb.Subjects) {
+			bindings[user] = append(bindings[user], "clusterrolebinding "+crb.Name+" -> "+crb.RoleRef.Name)
+		}
+	}
+	for _, rb := range rbs {
+		for _, user := range bindingUsers(rb.Subjects) {
+			bindings[user] = append(bindings[user], "rolebinding "+rb.Namespace+"/"+rb.Name+" -> "+rb.RoleRef.Name)
+		}
+	}
+	for user := range bindings {
+		sort.Strings(bindings[user])
+	}
+	return bindings
+}
+
+func bindingUsers(subjects []rbacv1.Subject) []string {
+	users := []string{}
+	for _, subject := range subjects {
+		if subject.Kind == rbacv1.UserKind && !strings.HasPrefix(subject.Name, "system:") {
+			users = append(users, subject.Name)
+		}
+	}
+	return users
+}
+
+// printPlanScript writes the plan as a shell script of kubectl commands for
+// an operator to review and run, with the filters of the cleanup. Stripping
+// cattle metadata from workloads is not part of the script.
+func printPlanScript(w io.Writer, apiExtClient clientset.Interface, pool dynamic.ClientPool, install string, components []component, chartCRDs []chartCRD,
+	clusters []v3.Cluster, projects []v3.Project, users []v3.User, projectNamespaces map[string][]string) error {
+	fmt.Fprintf(w, "#!/bin/sh\n# rancher removal plan generated by rmrancher %s\n# install: %s\nset -x\n", VERSION, describeInstall(install))
+
+	for _, c := range components {
+		fmt.Fprintf(w, "\n# %s\n", c.name)
+		if !skipNamespace(cattleNamespace) {
+			for _, name := range c.deployments {
+				fmt.Fprintf(w, "kubectl delete deployment -n %s %s --ignore-not-found\n", shellQuote(cattleNamespace), shellQuote(name))
+			}
+		}
+		if targetsClusterScope() {
+			if err := printScriptComponentObjects(w, pool, c, webhooksGroupVersion, webhookResources); err != nil {
+				return err
+			}
+		}
+		for _, group := range c.crdGroups {
+			if !servedGroups.Has(group) {
+				continue
+			}
+			crds, err := getCRDsForGroup(apiExtClient, group)
+			if err != nil {
+				return err
+			}
+			for _, crd := range crds {
+				items, err := getCustomResourceList(pool, crd, v1.ListOptions{})
+				if err != nil {
+					return err
+				}
+				remaining := 0
+				for _, item := range items {
+					if skipNamespace(item.GetNamespace()) || (c.release != "" && !c.ownsResource(&item)) {
+						remaining++
+						continue
+					}
+					printScriptDelete(w, crd.Name, item.GetNamespace(), item.GetName(), len(item.GetFinalizers()) > 0)
+				}
+				switch {
+				case c.release != "" && !c.ownsCRD(crd):
+				case c.release != "" && remaining > 0:
+					fmt.Fprintf(w, "# keeping %s of release %s, %d custom resources remain\n", crd.Name, c.release, remaining)
+				case keepCRDs, !targetsClusterScope():
+				default:
+					fmt.Fprintf(w, "kubectl delete crd %s --ignore-not-found\n", shellQuote(crd.Name))
+				}
+			}
+		}
+		if targetsClusterScope() {
+			if err := printScriptComponentObjects(w, pool, c, rbacGroupVersion, componentRBACResources); err != nil {
+				return err
+			}
+		}
+		namespaces := c.namespaces
+		if len(c.namespacePrefixes) > 0 {
+			existing, err := listObjects(pool, schema.GroupVersion{Version: "v1"}, namespacesResource, v1.ListOptions{})
+			if err != nil {
+				return err
+			}
+			for _, ns := range existing {
+				if hasAnyPrefix(ns.GetName(), c.namespacePrefixes) {
+					namespaces = append(namespaces, ns.GetName())
+				}
+			}
+		}
+		for _, namespace := range namespaces {
+			printScriptNamespaceDelete(w, namespace)
+		}
+	}
+
+	if len(chartCRDs) > 0 && !keepCRDs {
+		fmt.Fprintf(w, "\n# chart crds\n")
+		for _, c := range chartCRDs {
+			if c.remaining > 0 {
+				fmt.Fprintf(w, "# keeping %s of chart %s, %d custom resources remain\n", c.crd.Name, c.release, c.remaining)
+				continue
+			}
+			fmt.Fprintf(w, "kubectl delete crd %s --ignore-not-found\n", shellQuote(c.crd.Name))
+		}
+	}
+
+	fmt.Fprintf(w, "\n# projects\n")
+	for _, project := range projects {
+		if keepClusters[project.Namespace] {
+			continue
+		}
+		if includeProjectNamespaces {
+			for _, namespace := range projectNamespaces[project.Namespace+":"+project.Name] {
+				printScriptNamespaceDelete(w, namespace)
+			}
+		}
+		printScriptNamespaceDelete(w, project.Name)
+		if skipNamespace(project.Namespace) {
+			continue
+		}
+		printScriptDelete(w, "projects."+managementGroup, project.Namespace, project.Name, len(project.Finalizers) > 0)
+	}
+	fmt.Fprintf(w, "\n# clusters\n")
+	for _, cluster := range clusters {
+		if keepClusters[cluster.Name] {
+			continue
+		}
+		printScriptNamespaceDelete(w, cluster.Name)
+		if targetsClusterScope() {
+			printScriptDelete(w, "clusters."+managementGroup, "", cluster.Name, len(cluster.Finalizers) > 0)
+		}
+	}
+	fmt.Fprintf(w, "\n# users\n")
+	for _, user := range users {
+		if keepUsers[user.Name] {
+			continue
+		}
+		printScriptNamespaceDelete(w, user.Name)
+		if targetsClusterScope() {
+			printScriptDelete(w, "users."+managementGroup, "", user.Name, len(user.Finalizers) > 0)
+		}
+	}
+
+	fmt.Fprintf(w, "\n# rbac\n")
+	for _, resource := range []*v1.APIResource{
+		{Name: "clusterrolebindings", Kind: "ClusterRoleBinding"},
+		{Name: "clusterroles", Kind: "ClusterRole"},
+		{Name: "rolebindings", Kind: "RoleBinding", Namespaced: true},
+		{Name: "roles", Kind: "Role", Namespaced: true},
+	} {
+		if !resource.Namespaced && !targetsClusterScope() {
+			continue
+		}
+		items, err := listObjects(pool, rbacGroupVersion, resource, cattleListOptions)
+		if err != nil {
+			return err
+		}
+		for i := range items {
+			item := &items[i]
+			name := namespacedName(item.GetNamespace(), item.GetName())
+			if resource.Namespaced && skipNamespace(item.GetNamespace()) {
+				continue
+			}
+			if reason := keptReason(item); reason != "" {
+				fmt.Fprintf(w, "# keeping %s %s, %s\n", resource.Kind, name, reason)
+				continue
+			}
+			if reason := suspiciousReason(item); reason != "" && !deleteSuspicious {
+				fmt.Fprintf(w, "# review %s %s, it may not be rancher's: %s\n# ", resource.Kind, name, reason)
+			}
+			printScriptDelete(w, resource.Name, item.GetNamespace(), item.GetName(), false)
+		}
+		if resource.Name == "clusterroles" {
+			for _, clusterRole := range staticClusterRoles {
+				fmt.Fprintf(w, "kubectl delete clusterrole %s --ignore-not-found\n", shellQuote(clusterRole))
+			}
+		}
+	}
+
+	fmt.Fprintf(w, "\n# helm release\n")
+	if install == InstallHelm && !skipNamespace(cattleNamespace) {
+		fmt.Fprintf(w, "kubectl delete secrets -n %s -l %s\n", shellQuote(cattleNamespace), shellQuote(helmReleaseSelector))
+	}
+	if !skipNamespace(tillerNamespace) {
+		fmt.Fprintf(w, "kubectl delete configmaps -n %s -l %s\n", shellQuote(tillerNamespace), shellQuote(tillerReleaseSelector))
+	}
+
+	fmt.Fprintf(w, "\n# rancher deployment namespace\n")
+	printScriptNamespaceDelete(w, cattleNamespace)
+	return nil
+}
+
+// printScriptNamespaceDelete writes the command deleting namespace unless the
+// cleanup leaves it alone, see namespaceSkipReason.
+func printScriptNamespaceDelete(w io.Writer, namespace string) {
+	if reason := namespaceSkipReason(namespace); reason != "" {
+		fmt.Fprintf(w, "# keeping namespace %s, %s\n", namespace, reason)
+		return
+	}
+	printScriptDelete(w, "namespace", "", namespace, false)
+}
+
+// the cluster scoped objects of a component, matched by its prefixes, its
+// webhooks go before its custom resources and its rbac after them.
+var (
+	webhookResources = []*v1.APIResource{
+		{Name: "validatingwebhookconfigurations", Kind: "ValidatingWebhookConfiguration"},
+		{Name: "mutatingwebhookconfigurations", Kind: "MutatingWebhookConfiguration"},
+	}
+	componentRBACResources = []*v1.APIResource{
+		{Name: "clusterrolebindings", Kind: "ClusterRoleBinding"},
+		{Name: "clusterroles", Kind: "ClusterRole"},
+	}
+)
+
+// printScriptComponentObjects writes the commands deleting the objects of
+// resources that belong to c, see componentWebhooksCleanup and
+// componentRBACCleanup.
+func printScriptComponentObjects(w io.Writer, pool dynamic.ClientPool, c component, gv schema.GroupVersion, resources []*v1.APIResource) error {
+	for _, resource := range resources {
+		items, err := listObjects(pool, gv, resource, v1.ListOptions{})
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			if c.matches(item.GetName()) {
+				printScriptDelete(w, resource.Name, "", item.GetName(), false)
+			}
+		}
+	}
+	return nil
+}
+
+// printScriptDelete writes the commands deleting one object, its finalizers
+// are removed first when it has any.
+func printScriptDelete(w io.Writer, resource, namespace, name string, finalizers bool) {
+	target := resource + " " + shellQuote(name)
+	if namespace != "" {
+		target = resource + " -n " + shellQuote(namespace) + " " + shellQuote(name)
+	}
+	if finalizers {
+		fmt.Fprintf(w, "kubectl patch %s --type=merge -p '{\"metadata\":{\"finalizers\":null}}'\n", target)
+	}
+	fmt.Fprintf(w, "kubectl delete %s --ignore-not-found --wait=false\n", target)
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
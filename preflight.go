@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/kubernetes"
+)
+
+// supported range of kubernetes minor versions, apps/v1 is served since 1.9
+// and the beta apis the cleanup is built against are gone in 1.22.
+const (
+	minKubernetesMinor = 9
+	maxKubernetesMinor = 21
+)
+
+// requiredGroupVersions are the api group versions the cleanup talks to,
+// with what they are used for.
+var requiredGroupVersions = []struct {
+	groupVersion string
+	usedFor      string
+}{
+	{"v1", "namespaces, secrets, configmaps and volumes"},
+	{"apps/v1", "component deployments"},
+	{"rbac.authorization.k8s.io/v1", "rbac cleanup"},
+	{"authorization.k8s.io/v1", "permission preflight"},
+	{"apiextensions.k8s.io/v1beta1", "custom resource definitions"},
+	{"admissionregistration.k8s.io/v1beta1", "component webhooks and the recreation guard"},
+	{"extensions/v1beta1", "ingresses"},
+}
+
+type permission struct {
+	group    string
+	resource string
+	verbs    []string
+}
+
+// requiredPermissions are the cluster wide permissions the cleanup needs, the
+// custom resource groups of selected components are checked on top of these.
+var requiredPermissions = []permission{
+	{"", "namespaces", []string{"list", "get", "update", "delete"}},
+	{"", "secrets", []string{"list", "get", "update", "delete"}},
+	{"", "configmaps", []string{"list", "get", "update", "delete"}},
+	{"", "persistentvolumes", []string{"list", "update"}},
+	{"", "persistentvolumeclaims", []string{"list", "update"}},
+	{"", "services", []string{"list", "delete"}},
+	{"", "endpoints", []string{"list", "delete"}},
+	{"apps", "deployments", []string{"get", "update", "delete"}},
+	{"apps", "statefulsets", []string{"get", "update"}},
+	{"apps", "daemonsets", []string{"get", "update"}},
+	{"extensions", "ingresses", []string{"list", "delete"}},
+	{"networking.k8s.io", "networkpolicies", []string{"list", "delete"}},
+	{"autoscaling", "horizontalpodautoscalers", []string{"list", "delete"}},
+	{"policy", "poddisruptionbudgets", []string{"list", "delete"}},
+	{"rbac.authorization.k8s.io", "clusterroles", []string{"list", "delete", "deletecollection"}},
+	{"rbac.authorization.k8s.io", "clusterrolebindings", []string{"list", "update", "delete", "deletecollection"}},
+	{"rbac.authorization.k8s.io", "roles", []string{"list", "delete", "deletecollection"}},
+	{"rbac.authorization.k8s.io", "rolebindings", []string{"list", "update", "delete", "deletecollection"}},
+	{"apiextensions.k8s.io", "customresourcedefinitions", []string{"list", "delete"}},
+	{"admissionregistration.k8s.io", "validatingwebhookconfigurations", []string{"list", "delete"}},
+	{"admissionregistration.k8s.io", "mutatingwebhookconfigurations", []string{"list", "delete"}},
+	{managementGroup, "projects", []string{"list", "delete"}},
+	{managementGroup, "clusters", []string{"list", "delete"}},
+	{managementGroup, "users", []string{"list", "delete"}},
+	{managementGroup, "*", []string{"list", "update", "delete", "deletecollection"}},
+	{projectGroup, "*", []string{"list", "update", "deletecollection"}},
+	// cattle metadata is stripped from every namespaced kind
+	{"*", "*", []string{"list", "update"}},
+}
+
+// optionalPermissions are the permissions needed by the options of the run
+// on top of requiredPermissions.
+func optionalPermissions(ctx *cli.Context) []permission {
+	permissions := []permission{}
+	if ctx.Bool("snapshot") {
+		switch {
+		case servedGroups.Has(rancherBackupGroup):
+			permissions = append(permissions, permission{rancherBackupGroup, "backups", []string{"create", "get"}})
+		case servedGroups.Has(veleroGroup):
+			permissions = append(permissions, permission{veleroGroup, "backups", []string{"create", "get"}})
+		}
+	}
+	if ctx.Bool("deny-recreation") {
+		permissions = append(permissions,
+			permission{"admissionregistration.k8s.io", "validatingwebhookconfigurations", []string{"create"}},
+			permission{"", "namespaces", []string{"patch"}})
+	}
+	if deleteTiller {
+		permissions = append(permissions, permission{"", "serviceaccounts", []string{"delete"}})
+	}
+	return permissions
+}
+
+// preflightCheck reviews every required permission for the current user and
+// reports all missing ones at once, before anything is deleted.
+func preflightCheck(client *kubernetes.Clientset, permissions []permission) error {
+	missing := 0
+	for _, p := range permissions {
+		for _, verb := range p.verbs {
+			review, err := client.AuthorizationV1().SelfSubjectAccessReviews().Create(&authorizationv1.SelfSubjectAccessReview{
+				Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+					ResourceAttributes: &authorizationv1.ResourceAttributes{
+						Group:    p.group,
+						Resource: p.resource,
+						Verb:     verb,
+					},
+				},
+			})
+			if err != nil {
+				return err
+			}
+			if !review.Status.Allowed {
+				logrus.Errorf("missing permission: %s %s", verb, groupResource(p.group, p.resource))
+				missing++
+			}
+		}
+	}
+	if missing > 0 {
+		return fmt.Errorf("preflight check failed, %d permissions are missing", missing)
+	}
+	return nil
+}
+
+// compatibilityCheck checks the kubernetes version of the cluster against the
+// supported range and that every required api group version is served,
+// reporting all problems at once.
+func compatibilityCheck(client *kubernetes.Clientset) error {
+	info, err := client.Discovery().ServerVersion()
+	if err != nil {
+		return err
+	}
+	problems := 0
+	minor, err := strconv.Atoi(strings.TrimSuffix(info.Minor, "+"))
+	switch {
+	case err != nil || info.Major != "1":
+		logrus.Warnf("kubernetes version %s: unable to tell if it is supported", info.GitVersion)
+	case minor < minKubernetesMinor:
+		logrus.Errorf("kubernetes version %s: not supported, the minimum is v1.%d", info.GitVersion, minKubernetesMinor)
+		problems++
+	case minor > maxKubernetesMinor:
+		logrus.Warnf("kubernetes version %s: newer than v1.%d, the latest supported", info.GitVersion, maxKubernetesMinor)
+	default:
+		logrus.Infof("kubernetes version %s: supported", info.GitVersion)
+	}
+
+	groupList, err := client.Discovery().ServerGroups()
+	if err != nil {
+		return err
+	}
+	served := sets.NewString()
+	for _, group := range groupList.Groups {
+		for _, version := range group.Versions {
+			served.Insert(version.GroupVersion)
+		}
+	}
+	for _, required := range requiredGroupVersions {
+		if !served.Has(required.groupVersion) {
+			logrus.Errorf("api %s: not served, needed for %s", required.groupVersion, required.usedFor)
+			problems++
+		}
+	}
+	if problems > 0 {
+		return fmt.Errorf("compatibility check failed, the cluster is not supported by rmrancher %s", VERSION)
+	}
+	return nil
+}
+
+func componentPermissions(components []component) []permission {
+	permissions := []permission{}
+	for _, c := range components {
+		verbs := []string{"list", "update", "deletecollection"}
+		if c.release != "" {
+			// the custom resources of a release are deleted one by one
+			verbs = []string{"list", "update", "delete"}
+		}
+		for _, group := range c.crdGroups {
+			permissions = append(permissions, permission{group, "*", verbs})
+		}
+	}
+	return permissions
+}
+
+func groupResource(group, resource string) string {
+	if group == "" {
+		return resource
+	}
+	return resource + "." + group
+}
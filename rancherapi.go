@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/rancher/types/apis/management.cattle.io/v3"
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// rancherAPI talks to the v3 api of a rancher server that is still running,
+// deleting through it lets rancher tear down the nodes and cloud resources
+// behind provisioned clusters, see --rancher-api-token.
+type rancherAPI struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func newRancherAPI(serverURL, token string) *rancherAPI {
+	return &rancherAPI{
+		url:    strings.TrimSuffix(serverURL, "/") + "/v3",
+		token:  token,
+		client: &http.Client{Timeout: time.Minute},
+	}
+}
+
+func (a *rancherAPI) request(method, path string) (*http.Response, error) {
+	req, err := http.NewRequest(method, a.url+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(runContext)
+	req.Header.Set("Authorization", "Bearer "+a.token)
+	return a.client.Do(req)
+}
+
+func (a *rancherAPI) do(method, collection, id string) (int, error) {
+	resp, err := a.request(method, "/"+collection+"/"+url.PathEscape(id))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	return resp.StatusCode, nil
+}
+
+// tokenUser returns the id of the user the api token belongs to.
+func (a *rancherAPI) tokenUser() (string, error) {
+	resp, err := a.request(http.MethodGet, "/users?me=true")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return "", fmt.Errorf("looking up the user of the rancher api token: %s", http.StatusText(resp.StatusCode))
+	}
+	collection := struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&collection); err != nil {
+		return "", err
+	}
+	if len(collection.Data) == 0 {
+		return "", fmt.Errorf("looking up the user of the rancher api token: no user found")
+	}
+	return collection.Data[0].ID, nil
+}
+
+// delete deletes the object id of collection and waits for rancher to finish
+// removing it.
+func (a *rancherAPI) delete(collection, id string, timeout time.Duration) error {
+	status, err := a.do(http.MethodDelete, collection, id)
+	if err != nil {
+		return err
+	}
+	switch {
+	case status == http.StatusNotFound:
+		return nil
+	case status >= 300:
+		return fmt.Errorf("deleting %s [%s] through the rancher api: %s", collection, id, http.StatusText(status))
+	}
+	err = wait.PollImmediate(5*time.Second, timeout, func() (bool, error) {
+		status, err := a.do(http.MethodGet, collection, id)
+		if runContext.Err() != nil {
+			return false, runContext.Err()
+		}
+		if err != nil {
+			logrus.Warnf("checking %s [%s]: %v", collection, id, err)
+			return false, nil
+		}
+		return status == http.StatusNotFound, nil
+	})
+	if err == wait.ErrWaitTimeout {
+		return fmt.Errorf("timed out waiting for rancher to remove %s [%s]", collection, id)
+	}
+	return err
+}
+
+// gracefulDeprovision deletes clusters, projects and users through the
+// rancher api before their custom resources are removed, objects that are
+// kept or outside the target namespaces are left alone. The user of the api
+// token is never deleted through the api, the requests after it would fail,
+// its custom resource is removed with the other users.
+func gracefulDeprovision(api *rancherAPI, clusters []v3.Cluster, projects []v3.Project, users []v3.User, timeout time.Duration) error {
+	if targetsClusterScope() {
+		for _, cluster := range clusters {
+			if keepClusters[cluster.Name] || cluster.Status.Driver == v3.ClusterDriverLocal {
+				continue
+			}
+			logrus.Infof("deprovisioning cluster [%s] through the rancher api..", cluster.Name)
+			if err := api.delete("clusters", cluster.Name, timeout); err != nil {
+				return err
+			}
+		}
+	}
+	for _, project := range projects {
+		if keepClusters[project.Namespace] || skipNamespace(project.Namespace) || skipNamespace(project.Name) {
+			continue
+		}
+		logrus.Infof("deleting project [%s] through the rancher api..", project.Name)
+		if err := api.delete("projects", project.Namespace+":"+project.Name, timeout); err != nil {
+			return err
+		}
+	}
+	if !targetsClusterScope() {
+		return nil
+	}
+	tokenUser, err := api.tokenUser()
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		if keepUsers[user.Name] {
+			continue
+		}
+		if user.Name == tokenUser {
+			logrus.Infof("not deleting user [%s] through the rancher api, the api token belongs to it", user.Name)
+			continue
+		}
+		logrus.Infof("deleting user [%s] through the rancher api..", user.Name)
+		if err := api.delete("users", user.Name, timeout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
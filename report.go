@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/rancher/rmrancher/cleanup"
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	ResultDeleted = cleanup.ResultDeleted
+	ResultUpdated = cleanup.ResultUpdated
+	ResultSkipped = cleanup.ResultSkipped
+	ResultFailed  = cleanup.ResultFailed
+)
+
+// reportObject identifies an object, or a collection of objects when deleted
+// by selector, in the uninstall report.
+type reportObject = cleanup.Object
+
+type reportEntry struct {
+	reportObject
+	Timestamp time.Time `json:"timestamp"`
+	Result    string    `json:"result"`
+	Reason    string    `json:"reason,omitempty"`
+}
+
+// uninstallReport is the machine readable record of everything the cleanup
+// did, written to --report at the end of the run.
+type uninstallReport struct {
+	sync.Mutex
+	StartedAt  time.Time     `json:"startedAt"`
+	FinishedAt time.Time     `json:"finishedAt"`
+	Deleted    []reportEntry `json:"deleted"`
+	Updated    []reportEntry `json:"updated"`
+	Skipped    []reportEntry `json:"skipped"`
+	Failed     []reportEntry `json:"failed"`
+	// Credentials are the deleted objects that held credentials to join or
+	// access clusters, they are also listed in Deleted.
+	Credentials []reportEntry `json:"credentials"`
+	// Machines are the instances destroyed through their node drivers, see
+	// --delete-machines.
+	Machines []reportEntry `json:"machines"`
+	// APICalls are the api call statistics of every phase.
+	APICalls []apiPhaseStats `json:"apiCalls"`
+}
+
+var report = &uninstallReport{
+	StartedAt:   time.Now(),
+	Deleted:     []reportEntry{},
+	Updated:     []reportEntry{},
+	Skipped:     []reportEntry{},
+	Failed:      []reportEntry{},
+	Credentials: []reportEntry{},
+	Machines:    []reportEntry{},
+	APICalls:    []apiPhaseStats{},
+}
+
+func objectOf(apiVersion, kind string, obj v1.Object) reportObject {
+	return reportObject{
+		APIVersion:      apiVersion,
+		Kind:            kind,
+		Namespace:       obj.GetNamespace(),
+		Name:            obj.GetName(),
+		UID:             string(obj.GetUID()),
+		ResourceVersion: obj.GetResourceVersion(),
+	}
+}
+
+func namedObject(apiVersion, kind, namespace, name string) reportObject {
+	return reportObject{
+		APIVersion: apiVersion,
+		Kind:       kind,
+		Namespace:  namespace,
+		Name:       name,
+	}
+}
+
+func selectedObjects(apiVersion, kind, namespace, selector string) reportObject {
+	return reportObject{
+		APIVersion: apiVersion,
+		Kind:       kind,
+		Namespace:  namespace,
+		Selector:   selector,
+	}
+}
+
+// recordDelete records the outcome of deleting obj, objects that were already
+// gone are reported as skipped. It returns the failure as an objectError.
+func recordDelete(obj reportObject, err error) error {
+	return report.record(obj, ResultDeleted, err)
+}
+
+// recordUpdate records the outcome of updating obj, like recordDelete.
+func recordUpdate(obj reportObject, err error) error {
+	return report.record(obj, ResultUpdated, err)
+}
+
+// recordCredentialDelete records the outcome of deleting obj like
+// recordDelete, and calls it out as a credential when it was deleted.
+func recordCredentialDelete(obj reportObject, err error) error {
+	if err == nil {
+		entry := reportEntry{reportObject: obj, Timestamp: time.Now(), Result: ResultDeleted}
+		entry.Context = kubeContext
+		report.Lock()
+		report.Credentials = append(report.Credentials, entry)
+		report.Unlock()
+	}
+	return recordDelete(obj, err)
+}
+
+// recordMachineDelete records the outcome of destroying the instance of a
+// machine like recordDelete, and lists it with the machines when it was
+// destroyed.
+func recordMachineDelete(obj reportObject, err error) error {
+	if err == nil {
+		entry := reportEntry{reportObject: obj, Timestamp: time.Now(), Result: ResultDeleted}
+		entry.Context = kubeContext
+		report.Lock()
+		report.Machines = append(report.Machines, entry)
+		report.Unlock()
+	}
+	return recordDelete(obj, err)
+}
+
+func recordSkip(obj reportObject, reason string) {
+	report.add(reportEntry{reportObject: obj, Result: ResultSkipped, Reason: reason})
+}
+
+func (r *uninstallReport) record(obj reportObject, result string, err error) error {
+	entry := reportEntry{reportObject: obj, Result: result}
+	if errors.IsNotFound(err) {
+		entry.Result = ResultSkipped
+		entry.Reason = "not found"
+	} else if err != nil {
+		entry.Result = ResultFailed
+		entry.Reason = err.Error()
+	}
+	if auditErr := r.add(entry); auditErr != nil {
+		// changes that can't be audited must not go on
+		logrus.Errorf("%v, stopping the cleanup", auditErr)
+		cancelRun()
+		return auditErr
+	}
+	if entry.Result != ResultFailed {
+		return nil
+	}
+	obj.Context = kubeContext
+	failure := &objectError{Object: obj, Action: result, Err: err}
+	cleanup.CurrentEvents().Error(failure)
+	return failure
+}
+
+// add records entry in the report and the audit log, it returns the failure
+// to write the audit log.
+func (r *uninstallReport) add(entry reportEntry) error {
+	entry.Timestamp = time.Now()
+	entry.Context = kubeContext
+	var auditErr error
+	if audit != nil {
+		auditErr = audit.write(entry)
+	}
+	cleanup.CurrentEvents().Result(entry.reportObject, entry.Result, entry.Reason)
+	r.Lock()
+	defer r.Unlock()
+	switch entry.Result {
+	case ResultDeleted:
+		r.Deleted = append(r.Deleted, entry)
+	case ResultUpdated:
+		r.Updated = append(r.Updated, entry)
+	case ResultSkipped:
+		r.Skipped = append(r.Skipped, entry)
+	default:
+		r.Failed = append(r.Failed, entry)
+	}
+	return auditErr
+}
+
+func (r *uninstallReport) addAPIStats(stats []apiPhaseStats) {
+	r.Lock()
+	defer r.Unlock()
+	r.APICalls = append(r.APICalls, stats...)
+}
+
+// summary counts the objects of the report by result.
+func (r *uninstallReport) summary() string {
+	r.Lock()
+	defer r.Unlock()
+	return fmt.Sprintf("deleted %d, updated %d, skipped %d and failed %d objects", len(r.Deleted), len(r.Updated), len(r.Skipped), len(r.Failed))
+}
+
+func (r *uninstallReport) write(path string) error {
+	r.Lock()
+	defer r.Unlock()
+	r.FinishedAt = time.Now()
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+)
+
+// discoveryRefresh is how old the discovered api groups and resources may be
+// before a lookup missing from them discovers again.
+const discoveryRefresh = 10 * time.Second
+
+// cachedDiscovery keeps the api groups and resources discovered during the
+// run so every dynamic phase resolves against the same view of the server.
+type cachedDiscovery struct {
+	discovery.DiscoveryInterface
+	sync.Mutex
+	groups    *v1.APIGroupList
+	resources map[string]*v1.APIResourceList
+	fetched   time.Time
+}
+
+func (d *cachedDiscovery) ServerGroups() (*v1.APIGroupList, error) {
+	d.Lock()
+	defer d.Unlock()
+	if d.groups != nil {
+		return d.groups, nil
+	}
+	groups, err := d.DiscoveryInterface.ServerGroups()
+	if err != nil {
+		return nil, err
+	}
+	d.groups = groups
+	d.fetched = time.Now()
+	return groups, nil
+}
+
+func (d *cachedDiscovery) ServerResourcesForGroupVersion(groupVersion string) (*v1.APIResourceList, error) {
+	d.Lock()
+	defer d.Unlock()
+	if resources, ok := d.resources[groupVersion]; ok {
+		return resources, nil
+	}
+	resources, err := d.DiscoveryInterface.ServerResourcesForGroupVersion(groupVersion)
+	if err != nil {
+		return nil, err
+	}
+	d.resources[groupVersion] = resources
+	return resources, nil
+}
+
+// Fresh tells whether a lookup missing from the cache is worth discovering
+// again for, custom resource definitions may have come or gone since.
+func (d *cachedDiscovery) Fresh() bool {
+	d.Lock()
+	defer d.Unlock()
+	return time.Since(d.fetched) < discoveryRefresh
+}
+
+func (d *cachedDiscovery) Invalidate() {
+	d.Lock()
+	defer d.Unlock()
+	d.groups = nil
+	d.resources = map[string]*v1.APIResourceList{}
+}
+
+// restMapper resolves kinds to the resources and versions the server serves,
+// see newClientPool.
+var restMapper meta.RESTMapper
+
+// newClientPool returns a dynamic client pool for config and sets restMapper
+// up to discover the resources of the same server.
+func newClientPool(config *rest.Config) (dynamic.ClientPool, error) {
+	client, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	cache := &cachedDiscovery{DiscoveryInterface: client, resources: map[string]*v1.APIResourceList{}}
+	restMapper = discovery.NewDeferredDiscoveryRESTMapper(cache, dynamic.VersionInterfaces)
+	return dynamic.NewClientPool(config, restMapper, dynamic.LegacyAPIPathResolverFunc), nil
+}
+
+// resourceClient resolves the resource of gvk with restMapper and returns a
+// client for it. The version of gvk is preferred, the one the server prefers
+// is used when it is not served, so v1beta1 and v1 apis both work.
+func resourceClient(pool dynamic.ClientPool, gvk schema.GroupVersionKind) (dynamic.Interface, *v1.APIResource, error) {
+	mapping, err := restMapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if meta.IsNoMatchError(err) {
+		mapping, err = restMapper.RESTMapping(gvk.GroupKind())
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	client, err := pool.ClientForGroupVersionKind(mapping.GroupVersionKind)
+	if err != nil {
+		return nil, nil, err
+	}
+	resource := &v1.APIResource{
+		Name:       mapping.Resource,
+		Group:      mapping.GroupVersionKind.Group,
+		Version:    mapping.GroupVersionKind.Version,
+		Kind:       mapping.GroupVersionKind.Kind,
+		Namespaced: mapping.Scope.Name() == meta.RESTScopeNameNamespace,
+	}
+	return client, resource, nil
+}
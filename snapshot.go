@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+)
+
+const (
+	rancherBackupGroup = "resources.cattle.io"
+	veleroGroup        = "velero.io"
+	veleroNamespace    = "velero"
+)
+
+// snapshotKeepsBackup tells whether the --snapshot backup is stored by
+// rancher-backup, which then outlives the cleanup along with its namespace,
+// crds and backups.
+func snapshotKeepsBackup(ctx *cli.Context) bool {
+	return ctx.Bool("snapshot") && servedGroups.Has(rancherBackupGroup)
+}
+
+// takeSnapshot creates a backup with the rancher-backup operator, or velero
+// when it is not installed, and waits for it to complete, see --snapshot.
+func takeSnapshot(pool dynamic.ClientPool, timeout time.Duration) error {
+	name := "rmrancher-" + time.Now().UTC().Format("20060102150405")
+	switch {
+	case servedGroups.Has(rancherBackupGroup):
+		backup := &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": rancherBackupGroup + "/v1",
+			"kind":       "Backup",
+			"metadata":   map[string]interface{}{"name": name},
+			"spec": map[string]interface{}{
+				"resourceSetName": "rancher-resource-set",
+			},
+		}}
+		return createBackup(pool, backup, "", timeout, func(obj *unstructured.Unstructured) (bool, error) {
+			return isConditionTrue(obj.Object, "Ready"), nil
+		})
+	case servedGroups.Has(veleroGroup):
+		backup := &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": veleroGroup + "/v1",
+			"kind":       "Backup",
+			"metadata":   map[string]interface{}{"name": name, "namespace": veleroNamespace},
+			"spec": map[string]interface{}{
+				"includedNamespaces": []interface{}{"*"},
+			},
+		}}
+		return createBackup(pool, backup, veleroNamespace, timeout, func(obj *unstructured.Unstructured) (bool, error) {
+			phase, _, _ := unstructured.NestedString(obj.Object, "status", "phase")
+			switch phase {
+			case "Completed":
+				return true, nil
+			case "Failed", "PartiallyFailed", "FailedValidation":
+				return false, fmt.Errorf("velero backup [%s/%s] %s", veleroNamespace, obj.GetName(), phase)
+			}
+			return false, nil
+		})
+	}
+	return fmt.Errorf("neither rancher-backup nor velero is installed, pass --no-snapshot to continue without a backup")
+}
+
+func createBackup(pool dynamic.ClientPool, backup *unstructured.Unstructured, namespace string, timeout time.Duration, done func(*unstructured.Unstructured) (bool, error)) error {
+	gv, err := schema.ParseGroupVersion(backup.GetAPIVersion())
+	if err != nil {
+		return err
+	}
+	client, resource, err := resourceClient(pool, gv.WithKind(backup.GetKind()))
+	if err != nil {
+		return err
+	}
+	logrus.Infof("creating backup [%s] with %s..", namespacedName(namespace, backup.GetName()), gv.Group)
+	if _, err := client.Resource(resource, namespace).Create(backup); err != nil {
+		return err
+	}
+	err = wait.PollImmediate(5*time.Second, timeout, func() (bool, error) {
+		obj, err := client.Resource(resource, namespace).Get(backup.GetName(), v1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		return done(obj)
+	})
+	if err == wait.ErrWaitTimeout {
+		return fmt.Errorf("timed out waiting for backup [%s] to complete", namespacedName(namespace, backup.GetName()))
+	}
+	if err != nil {
+		return err
+	}
+	logrus.Infof("backup [%s] completed", namespacedName(namespace, backup.GetName()))
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rancher/rmrancher/cleanup"
+	"github.com/sirupsen/logrus"
+)
+
+// objectTimeout bounds every api request of the cleanup and phaseTimeout
+// every phase, see --object-timeout and --phase-timeout.
+var (
+	objectTimeout time.Duration
+	phaseTimeout  time.Duration
+)
+
+// cleanupStep is a node of the cleanup graph, it runs once every step it
+// depends on is done.
+type cleanupStep struct {
+	name string
+	// phase is the --only phase the step belongs to, steps without one always
+	// run.
+	phase string
+	// after are the names of the steps that have to run first.
+	after []string
+	run   func() error
+}
+
+// orderSteps sorts steps so every step comes after its dependencies, steps
+// free to run keep their declaration order.
+func orderSteps(steps []cleanupStep) ([]cleanupStep, error) {
+	index := map[string]int{}
+	for i, step := range steps {
+		if _, ok := index[step.name]; ok {
+			return nil, fmt.Errorf("duplicate cleanup step [%s]", step.name)
+		}
+		index[step.name] = i
+	}
+	pending := make([]int, len(steps))
+	dependents := make([][]int, len(steps))
+	for i, step := range steps {
+		for _, name := range step.after {
+			j, ok := index[name]
+			if !ok {
+				return nil, fmt.Errorf("cleanup step [%s] depends on unknown step [%s]", step.name, name)
+			}
+			pending[i]++
+			dependents[j] = append(dependents[j], i)
+		}
+	}
+	ordered := []cleanupStep{}
+	done := make([]bool, len(steps))
+	for len(ordered) < len(steps) {
+		next := -1
+		for i := range steps {
+			if !done[i] && pending[i] == 0 {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			cycle := []string{}
+			for i, step := range steps {
+				if !done[i] {
+					cycle = append(cycle, step.name)
+				}
+			}
+			return nil, fmt.Errorf("cleanup steps depend on each other: %s", strings.Join(cycle, ", "))
+		}
+		done[next] = true
+		ordered = append(ordered, steps[next])
+		for _, i := range dependents[next] {
+			pending[i]--
+		}
+	}
+	return ordered, nil
+}
+
+// runSteps runs the steps of the selected phases in dependency order and
+// stops at the first failure. With --object-timeout or --phase-timeout a step
+// that times out is given up on and the others still run. The phase deadlines
+// apply to the requests of scope.
+func runSteps(steps []cleanupStep, scope *requestScope) error {
+	ordered, err := orderSteps(steps)
+	if err != nil {
+		return err
+	}
+	defer scope.set(runContext)
+	started := map[string]bool{}
+	deadlines := map[string]time.Time{}
+	errs := []error{}
+	for _, step := range ordered {
+		if step.phase != "" {
+			if !runPhase(step.phase) {
+				continue
+			}
+			if !started[step.phase] {
+				started[step.phase] = true
+				cleanup.CurrentEvents().PhaseStart(step.phase)
+			}
+		}
+		// steps outside of a phase are timed on their own
+		phase := step.phase
+		if phase == "" {
+			phase = step.name
+		}
+		apiStats.setPhase(phase)
+		cancel := func() {}
+		if phaseTimeout > 0 {
+			if _, ok := deadlines[phase]; !ok {
+				deadlines[phase] = time.Now().Add(phaseTimeout)
+			}
+			var ctx context.Context
+			ctx, cancel = context.WithDeadline(runContext, deadlines[phase])
+			scope.set(ctx)
+		}
+		err := step.run()
+		cancel()
+		if err == nil {
+			continue
+		}
+		if (objectTimeout == 0 && phaseTimeout == 0) || runContext.Err() != nil || !isTimeout(err) {
+			return err
+		}
+		logrus.Errorf("giving up on cleanup step [%s] of [%s] after a timeout: %v", step.name, phase, err)
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		return cleanupErrors(errs)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+// how deletions are carried out, see --strategy.
+const (
+	// StrategyForce strips finalizers and deletes without waiting for anyone.
+	StrategyForce = "force"
+	// StrategyGraceful leaves finalizers to their controllers and waits for
+	// rancher, when it still runs, to finish every cluster, project and user
+	// deletion.
+	StrategyGraceful = "graceful"
+)
+
+// strategy is the deletion strategy of the run.
+var strategy = StrategyForce
+
+// waitForControllers is set when the strategy is graceful and rancher is
+// running to process the deletions.
+var waitForControllers bool
+
+// defaultGracefulWait bounds the wait for a deletion when --object-timeout is
+// not set.
+const defaultGracefulWait = 10 * time.Minute
+
+// stripFinalizers reports whether the cleanup removes finalizers itself.
+func stripFinalizers() bool {
+	return strategy == StrategyForce
+}
+
+// rancherRunning reports whether the rancher deployment has ready replicas. A
+// single node rancher has no deployment, it runs while its embedded cluster
+// answers.
+func rancherRunning(client *kubernetes.Clientset) (bool, error) {
+	if installType == InstallSingleNode {
+		return true, nil
+	}
+	deployment, err := client.AppsV1().Deployments(cattleNamespace).Get("rancher", v1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return deployment.Status.ReadyReplicas > 0, nil
+}
+
+// waitDeleted polls get until the object is gone, with the graceful strategy
+// and rancher running only. An object still there after the wait is left to
+// the next phases.
+func waitDeleted(kind, name string, get func() error) error {
+	if !waitForControllers {
+		return nil
+	}
+	timeout := defaultGracefulWait
+	if objectTimeout > 0 {
+		timeout = objectTimeout
+	}
+	logrus.Infof("waiting for rancher to remove %s [%s]..", kind, name)
+	err := wait.PollImmediate(2*time.Second, timeout, func() (bool, error) {
+		if runContext.Err() != nil {
+			return false, runContext.Err()
+		}
+		err := get()
+		if errors.IsNotFound(err) {
+			return true, nil
+		}
+		return false, err
+	})
+	if err == wait.ErrWaitTimeout {
+		logrus.Warnf("%s [%s] is still there after %v", kind, name, timeout)
+		return nil
+	}
+	return err
+}
+
+func validateStrategy(name string) error {
+	if name != StrategyForce && name != StrategyGraceful {
+		return fmt.Errorf("invalid strategy [%s], must be one of %s|%s", name, StrategyGraceful, StrategyForce)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+// rancherPodSelectors match the pods of rancher, its webhook, its agents and
+// fleet wherever they run.
+var rancherPodSelectors = []string{
+	"app=rancher",
+	"app=rancher-webhook",
+	"app=cattle-cluster-agent",
+	"app=cattle-agent",
+	"app=fleet-agent",
+	"app=fleet-controller",
+	"app=gitjob",
+}
+
+// verifyTimeout bounds the wait for terminating rancher pods to be gone.
+const verifyTimeout = 2 * time.Minute
+
+// getRancherPods returns the pods matching rancherPodSelectors along with every
+// pod of the rancher namespaces, as "<namespace>/<name>" mapped to the pod.
+func getRancherPods(client *kubernetes.Clientset) (map[string]corev1.Pod, error) {
+	pods := map[string]corev1.Pod{}
+	for _, selector := range rancherPodSelectors {
+		podList, err := client.CoreV1().Pods("").List(v1.ListOptions{LabelSelector: selector})
+		if err != nil {
+			return nil, err
+		}
+		for _, pod := range podList.Items {
+			pods[namespacedName(pod.Namespace, pod.Name)] = pod
+		}
+	}
+	podList, err := client.CoreV1().Pods("").List(v1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for _, pod := range podList.Items {
+		if isRancherNamespace(pod.Namespace) {
+			pods[namespacedName(pod.Namespace, pod.Name)] = pod
+		}
+	}
+	for name, pod := range pods {
+		if skipNamespace(pod.Namespace) {
+			delete(pods, name)
+		}
+	}
+	return pods, nil
+}
+
+// verifyRancherGone waits for the rancher pods to be gone after the cleanup
+// and fails with the ones still there, like agents that registered again.
+func verifyRancherGone(client *kubernetes.Clientset) error {
+	var pods map[string]corev1.Pod
+	err := wait.PollImmediate(5*time.Second, verifyTimeout, func() (bool, error) {
+		if runContext.Err() != nil {
+			return false, runContext.Err()
+		}
+		var err error
+		pods, err = getRancherPods(client)
+		return len(pods) == 0, err
+	})
+	if err == nil {
+		logrus.Infof("no rancher pods remain")
+		return nil
+	}
+	if err != wait.ErrWaitTimeout {
+		return err
+	}
+	for _, name := range sets.StringKeySet(pods).List() {
+		pod := pods[name]
+		state := string(pod.Status.Phase)
+		if pod.DeletionTimestamp != nil {
+			state = "Terminating"
+		}
+		logrus.Warnf("rancher pod [%s] is still %s", name, state)
+	}
+	return fmt.Errorf("%d rancher pods remain after the cleanup", len(pods))
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/cache"
+)
+
+// watchDrainTimeout bounds how long the watcher waits for terminating
+// objects to go away once the cleanup is done.
+const watchDrainTimeout = 5 * time.Minute
+
+// finalizerWatcher strips the finalizers rancher controllers that are still
+// running put back on objects being deleted, see --watch.
+type finalizerWatcher struct {
+	stopCh chan struct{}
+	stores []cache.Store
+	synced []cache.InformerSynced
+}
+
+// startFinalizerWatcher watches namespaces and every cattle custom resource
+// until stop is called.
+func startFinalizerWatcher(apiExtClient clientset.Interface, pool dynamic.ClientPool) (*finalizerWatcher, error) {
+	w := &finalizerWatcher{stopCh: make(chan struct{})}
+	coreClient, err := pool.ClientForGroupVersionKind(schema.GroupVersionKind{Version: "v1"})
+	if err != nil {
+		return nil, err
+	}
+	w.watch(coreClient, &v1.APIResource{Name: "namespaces", Kind: "Namespace"}, "v1", cleanupFinalizers)
+	crdList, err := apiExtClient.ApiextensionsV1beta1().CustomResourceDefinitions().List(v1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for _, crd := range crdList.Items {
+		if !isCattleGroup(crd.Spec.Group) {
+			continue
+		}
+		client, resource, err := getCustomResourceClient(pool, crd)
+		if err != nil {
+			return nil, err
+		}
+		// custom resources lose every finalizer, as in customResourcesCleanup
+		w.watch(client, resource, crd.Spec.Group+"/"+crd.Spec.Version, func([]string) []string { return nil })
+	}
+	if !cache.WaitForCacheSync(w.stopCh, w.synced...) {
+		close(w.stopCh)
+		return nil, fmt.Errorf("finalizer watcher failed to sync")
+	}
+	logrus.Infof("watching %d resources for re-added finalizers", len(w.stores))
+	return w, nil
+}
+
+func (w *finalizerWatcher) watch(client dynamic.Interface, resource *v1.APIResource, apiVersion string, finalizers func([]string) []string) {
+	resourceClient := client.Resource(resource, "")
+	lw := &cache.ListWatch{
+		ListFunc: func(opts v1.ListOptions) (runtime.Object, error) {
+			return resourceClient.List(opts)
+		},
+		WatchFunc: func(opts v1.ListOptions) (watch.Interface, error) {
+			return resourceClient.Watch(opts)
+		},
+	}
+	strip := func(obj interface{}) {
+		item, ok := obj.(*unstructured.Unstructured)
+		if !ok || item.GetDeletionTimestamp() == nil || len(item.GetFinalizers()) == 0 {
+			return
+		}
+		namespace := item.GetNamespace()
+		if resource.Kind == "Namespace" {
+			namespace = item.GetName()
+		}
+		if skipNamespace(namespace) {
+			return
+		}
+		updated := finalizers(item.GetFinalizers())
+		if len(updated) == len(item.GetFinalizers()) {
+			return
+		}
+		item = item.DeepCopy()
+		item.SetFinalizers(updated)
+		_, err := client.Resource(resource, item.GetNamespace()).Update(item)
+		recordUpdate(objectOf(apiVersion, resource.Kind, item), err)
+		if err != nil && !errors.IsNotFound(err) {
+			logrus.Warnf("failed to strip finalizers of %s [%s]: %v", resource.Kind, namespacedName(item.GetNamespace(), item.GetName()), err)
+			return
+		}
+		logrus.Infof("stripped re-added finalizers of %s [%s]", resource.Kind, namespacedName(item.GetNamespace(), item.GetName()))
+	}
+	store, controller := cache.NewInformer(lw, &unstructured.Unstructured{}, 0, cache.ResourceEventHandlerFuncs{
+		AddFunc: strip,
+		UpdateFunc: func(_, obj interface{}) {
+			strip(obj)
+		},
+	})
+	w.stores = append(w.stores, store)
+	w.synced = append(w.synced, controller.HasSynced)
+	go controller.Run(w.stopCh)
+}
+
+// stop waits for the objects being deleted to be gone, up to
+// watchDrainTimeout, and stops the watcher.
+func (w *finalizerWatcher) stop() {
+	defer close(w.stopCh)
+	err := wait.PollImmediate(time.Second, watchDrainTimeout, func() (bool, error) {
+		for _, store := range w.stores {
+			for _, obj := range store.List() {
+				if item, ok := obj.(*unstructured.Unstructured); ok && item.GetDeletionTimestamp() != nil {
+					return false, nil
+				}
+			}
+		}
+		return true, nil
+	})
+	if err != nil {
+		logrus.Warnf("objects are still terminating after %v", watchDrainTimeout)
+	}
+}
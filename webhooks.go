@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	admissionv1beta1 "k8s.io/api/admissionregistration/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// what to do with webhooks that fail closed while their backend is gone, see
+// --dead-webhooks.
+const (
+	DeadWebhooksWarn   = "warn"
+	DeadWebhooksIgnore = "ignore"
+	DeadWebhooksDelete = "delete"
+)
+
+// deadWebhooks is the action taken on dead webhooks.
+var deadWebhooks = DeadWebhooksWarn
+
+// deadWebhookReason tells why a webhook with failurePolicy Fail blocks every
+// request it matches: its service does not exist or has no ready endpoints.
+// It returns "" when the webhook is fine.
+func deadWebhookReason(client *kubernetes.Clientset, webhook admissionv1beta1.Webhook) (string, error) {
+	if webhook.FailurePolicy == nil || *webhook.FailurePolicy != admissionv1beta1.Fail || webhook.ClientConfig.Service == nil {
+		return "", nil
+	}
+	service := webhook.ClientConfig.Service
+	name := namespacedName(service.Namespace, service.Name)
+	if _, err := client.CoreV1().Services(service.Namespace).Get(service.Name, v1.GetOptions{}); errors.IsNotFound(err) {
+		return fmt.Sprintf("service [%s] does not exist", name), nil
+	} else if err != nil {
+		return "", err
+	}
+	endpoints, err := client.CoreV1().Endpoints(service.Namespace).Get(service.Name, v1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return fmt.Sprintf("service [%s] has no endpoints", name), nil
+	} else if err != nil {
+		return "", err
+	}
+	for _, subset := range endpoints.Subsets {
+		if len(subset.Addresses) > 0 {
+			return "", nil
+		}
+	}
+	return fmt.Sprintf("service [%s] has no ready endpoints", name), nil
+}
+
+// deadWebhooksCleanup finds the webhooks of every configuration that would
+// block deletions because their backend is dead, and warns about them, sets
+// their failurePolicy to Ignore or deletes their configuration.
+func deadWebhooksCleanup(client *kubernetes.Clientset) error {
+	validating, err := client.AdmissionregistrationV1beta1().ValidatingWebhookConfigurations().List(v1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for _, config := range validating.Items {
+		dead, err := neutralizeDeadWebhooks("ValidatingWebhookConfiguration", config.Name, config.Webhooks, client)
+		if err != nil {
+			return err
+		}
+		if !dead {
+			continue
+		}
+		if deadWebhooks == DeadWebhooksDelete {
+			logrus.Infof("deleting validating webhook configuration [%s]..", config.Name)
+			err = client.AdmissionregistrationV1beta1().ValidatingWebhookConfigurations().Delete(config.Name, getDeleteOptions())
+			err = recordDelete(objectOf(admissionAPIVersion, "ValidatingWebhookConfiguration", &config), err)
+		} else {
+			_, err = client.AdmissionregistrationV1beta1().ValidatingWebhookConfigurations().Update(&config)
+			err = recordUpdate(objectOf(admissionAPIVersion, "ValidatingWebhookConfiguration", &config), err)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	mutating, err := client.AdmissionregistrationV1beta1().MutatingWebhookConfigurations().List(v1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for _, config := range mutating.Items {
+		dead, err := neutralizeDeadWebhooks("MutatingWebhookConfiguration", config.Name, config.Webhooks, client)
+		if err != nil {
+			return err
+		}
+		if !dead {
+			continue
+		}
+		if deadWebhooks == DeadWebhooksDelete {
+			logrus.Infof("deleting mutating webhook configuration [%s]..", config.Name)
+			err = client.AdmissionregistrationV1beta1().MutatingWebhookConfigurations().Delete(config.Name, getDeleteOptions())
+			err = recordDelete(objectOf(admissionAPIVersion, "MutatingWebhookConfiguration", &config), err)
+		} else {
+			_, err = client.AdmissionregistrationV1beta1().MutatingWebhookConfigurations().Update(&config)
+			err = recordUpdate(objectOf(admissionAPIVersion, "MutatingWebhookConfiguration", &config), err)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// neutralizeDeadWebhooks reports the dead webhooks of a configuration and
+// whether it has to be changed, their failurePolicy is set to Ignore in place
+// when --dead-webhooks is ignore.
+func neutralizeDeadWebhooks(kind, name string, webhooks []admissionv1beta1.Webhook, client *kubernetes.Clientset) (bool, error) {
+	dead := false
+	ignore := admissionv1beta1.Ignore
+	for i := range webhooks {
+		reason, err := deadWebhookReason(client, webhooks[i])
+		if err != nil {
+			return false, err
+		}
+		if reason == "" {
+			continue
+		}
+		logrus.Warnf("webhook [%s] of %s [%s] fails closed and blocks deletions: %s", webhooks[i].Name, kind, name, reason)
+		if deadWebhooks == DeadWebhooksIgnore {
+			logrus.Infof("setting failure policy of webhook [%s] to Ignore..", webhooks[i].Name)
+			webhooks[i].FailurePolicy = &ignore
+		}
+		dead = true
+	}
+	return dead && deadWebhooks != DeadWebhooksWarn, nil
+}